@@ -9,7 +9,7 @@ require (
 	github.com/pkg/sftp v1.13.0 // indirect
 	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/withmandala/go-log v0.1.0
-	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2 // indirect
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	golang.org/x/sys v0.0.0-20210403161142-5e06dd20ab57 // indirect
-	golang.org/x/term v0.0.0-20210317153231-de623e64d2a6 // indirect
+	golang.org/x/term v0.0.0-20210317153231-de623e64d2a6
 )
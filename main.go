@@ -1,208 +1,571 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
-	"github.com/klauspost/cpuid/v2"
 	"github.com/tbhaxor/syncbit/utils"
 	"os"
-	"path"
+	"strings"
 	"sync"
+	"time"
 )
 
-// HandleTransfer is used to take backup, execute hooks and restore the zip file
-func HandleTransfer(file utils.File, conn utils.SSHConnections, wg *sync.WaitGroup, conf utils.Config) {
+// removeRemote will delete the paths on the adaptor, unsafe paths are refused
+func removeRemote(exec utils.Executor, adaptor string, paths ...string) {
+	cmd, err := utils.RemoveCommand(paths...)
+	if err != nil {
+		utils.Log.Warnf("Not removing %s from %s adaptor. Error message: %s", strings.Join(paths, ", "), adaptor, err.Error())
+		return
+	}
+
+	utils.Log.Tracef("Removing %s from %s adaptor", strings.Join(paths, ", "), adaptor)
+	if _, err := exec.Run(cmd); err != nil {
+		utils.Log.Tracef("Error while removing %s from %s adaptor. Error message: %s", strings.Join(paths, ", "), adaptor, err.Error())
+	}
+}
+
+// removeArchive will delete the archive along with its list, volumes, markers and checksums from the adaptor
+func removeArchive(exec utils.Executor, adaptor string, archive string) {
+	cmd, err := utils.RemoveArchiveCommand(archive)
+	if err != nil {
+		utils.Log.Warnf("Not removing %s from %s adaptor. Error message: %s", archive, adaptor, err.Error())
+		return
+	}
+
+	utils.Log.Tracef("Removing %s from %s adaptor", archive, adaptor)
+	if _, err := exec.Run(cmd); err != nil {
+		utils.Log.Tracef("Error while removing %s from %s adaptor. Error message: %s", archive, adaptor, err.Error())
+	}
+}
+
+// HandleTransfer is used to take backup, execute hooks and restore the archive
+func HandleTransfer(file utils.File, conn utils.SSHConnections, wg *sync.WaitGroup, conf utils.Config, run *utils.Run) {
 	// when complete, mark it done
 	defer wg.Done()
 
 	// getting adopter details
 	adaptors := []*utils.Adaptor{utils.GetAdaptorFromName(file.Src.Adaptor, conf), utils.GetAdaptorFromName(file.Dest.Adaptor, conf)}
 
-	utils.Log.Infof("Backing up %s@%s:%s", adaptors[0].User, adaptors[0].Host, file.Src.Path)
+	// outcome of the transfer is added to the run report when it is over
+	report := utils.NewFileReport(file, conf)
+	defer run.Report.Add(report)
+
+	// executors run the commands on the adaptors, through sudo when become is enabled
+	srcExec, destExec := utils.NewFileExecutor(conn, file, true, conf), utils.NewFileExecutor(conn, file, false, conf)
+	archiver := utils.GetArchiver(file.Format)
+
+	// staging name is generated early, so that it is available in templates. It is stable across runs for resuming
+	staging := utils.NewStagingPaths(file, conf, archiver)
+
+	// template data for the hooks and paths, it holds the vars registered during this transfer
+	data := utils.NewTemplateData(file, conf, run.ID, staging.Name)
 
 	// ------ Source Transfer Begin ------
-	utils.Log.Tracef("Executing global pre backup hooks")
-	for _, step := range conf.Global.Hooks.PreBackup {
-		if _, err := conn[file.Src.Adaptor].Run(step); err != nil {
-			utils.Log.Tracef("Error while executing '%s' global pre backup hook. Error message: %s", step, err.Error())
-		}
+	if err := utils.RunStage(conn, utils.PreBackup, &file, conf, &data); err != nil {
+		report.Fail("Skipping %s@%s:%s because %s stage failed due to error: %s", adaptors[0].User, adaptors[0].Host, file.Src.Path, utils.PreBackup, err.Error())
+		return
 	}
-	utils.Log.Tracef("Completed global pre backup hooks")
+	report.Src = fmt.Sprintf("%s@%s:%s", adaptors[0].User, adaptors[0].Host, file.Src.Path)
 
-	utils.Log.Tracef("Executing scoped pre backup hooks")
-	for _, step := range file.Src.PreBackup {
-		if _, err := conn[file.Src.Adaptor].Run(fmt.Sprintf("cd %s && %s", file.Src.Path, step)); err != nil {
-			utils.Log.Tracef("Error while executing '%s' global pre backup hook. Error message: %s", step, err.Error())
+	utils.Log.Infof("Backing up %s@%s:%s", adaptors[0].User, adaptors[0].Host, file.Src.Path)
+
+	// record the owners before archiving, as archive doesn't carry them for non root users
+	var owners utils.Ownership
+	if file.Dest.PreserveOwnership {
+		utils.Log.Tracef("Recording ownership of %s@%s:%s", adaptors[0].User, adaptors[0].Host, file.Src.Path)
+		var err error
+		if owners, err = utils.CaptureOwnership(srcExec, file.Src.Path); err != nil {
+			report.Fail("Skipping %s@%s:%s because recording ownership failed due to error: %s", adaptors[0].User, adaptors[0].Host, file.Src.Path, err.Error())
+			return
 		}
 	}
-	utils.Log.Tracef("Completed scoped pre backup hooks")
 
-	utils.Log.Tracef("Starting to zip %s@%s:%s", adaptors[0].User, adaptors[0].Host, file.Src.Path)
-	// zip file in the directory
-	if _, err := conn[file.Src.Adaptor].Run(fmt.Sprintf("cd %s && zip dump.zip -r .", file.Src.Path)); err != nil {
-		utils.Log.Warnf("Skipping %s@%s:%s because zipping failed due to error: %s", adaptors[0].User, adaptors[0].Host, file.Src.Path, err.Error())
-		return
+	// report the metadata which will be lost with the archive format
+	if warnings, err := utils.DetectMetadataLoss(srcExec, file.Src.Path, archiver); err == nil {
+		for _, warning := range warnings {
+			report.Warn("%s@%s:%s: %s", adaptors[0].User, adaptors[0].Host, file.Src.Path, warning)
+		}
+	} else {
+		utils.Log.Tracef("Couldn't detect the metadata loss of %s@%s:%s. Error message: %s", adaptors[0].User, adaptors[0].Host, file.Src.Path, err.Error())
 	}
-	utils.Log.Tracef("Completed zipping %s@%s:%s", adaptors[0].User, adaptors[0].Host, file.Src.Path)
 
-	utils.Log.Tracef("Executing global post backup hooks")
-	for _, step := range conf.Global.Hooks.PostBackup {
-		if _, err := conn[file.Src.Adaptor].Run(step); err != nil {
-			utils.Log.Tracef("Error while executing '%s' global post backup hook. Error message: %s", step, err.Error())
+	// manifest of the source is built before archiving
+	var manifest utils.Manifest
+	if file.Dest.Verify != utils.VerifyOff {
+		utils.Log.Tracef("Building manifest of %s@%s:%s", adaptors[0].User, adaptors[0].Host, file.Src.Path)
+		var err error
+		if manifest, err = utils.BuildManifest(srcExec, file.Src.Path); err != nil {
+			report.Fail("Skipping %s@%s:%s because building manifest failed due to error: %s", adaptors[0].User, adaptors[0].Host, file.Src.Path, err.Error())
+			return
 		}
 	}
-	utils.Log.Tracef("Completed global post backup hooks")
 
-	utils.Log.Tracef("Executing scoped post backup hooks")
-	for _, step := range file.Src.PostBackup {
-		if _, err := conn[file.Src.Adaptor].Run(fmt.Sprintf("cd %s && %s", file.Src.Path, step)); err != nil {
-			utils.Log.Tracef("Error while executing '%s' scoped post backup hook. Error message: %s", step, err.Error())
+	// archive is created in the staging directory of the source, it is downloaded to the local staging and uploaded
+	// to the staging of the destination
+	srcArchive, localArchive, destArchive := staging.Src, staging.Local, staging.Dest
+
+	// clean the files when the function is over. When a download or upload broke, the staging files are kept along
+	// with the checksums of the source archive, so that the next run reuses the archive and resumes the transfer
+	var parts, volumes []utils.Part
+	resumable := false
+	defer func() {
+		if resumable {
+			err := utils.SaveChecksums(srcExec, srcArchive, parts)
+			if err == nil {
+				utils.Log.Infof("Keeping %s@%s:%s, %s and %s@%s:%s to resume the transfer in the next run", adaptors[0].User, adaptors[0].Host, srcArchive, localArchive, adaptors[1].User, adaptors[1].Host, destArchive)
+				return
+			}
+			utils.Log.Warnf("Transfer of %s@%s:%s can't be resumed, saving checksums failed due to error: %s", adaptors[0].User, adaptors[0].Host, srcArchive, err.Error())
 		}
-	}
-	utils.Log.Tracef("Completed scoped post backup hooks")
 
-	utils.Log.Tracef("Executing global pre download hooks")
-	for _, step := range conf.Global.Hooks.PreDownload {
-		if _, err := conn[file.Src.Adaptor].Run(step); err != nil {
-			utils.Log.Tracef("Error while executing '%s' global pre download hook. Error message: %s", step, err.Error())
+		removeArchive(srcExec, file.Src.Adaptor, srcArchive)
+		for _, local := range utils.VolumeFiles(localArchive, len(volumes)) {
+			utils.Log.Tracef("Removing %s", local)
+			os.Remove(local)
+		}
+		removeArchive(destExec, file.Dest.Adaptor, destArchive)
+	}()
+
+	// archive kept by the broken transfer of the previous run is reused, so that the partial copies can be resumed
+	parts, kept := utils.KeptArchive(srcExec, srcArchive)
+	if kept {
+		utils.Log.Infof("Reusing %s@%s:%s kept by the previous run, later changes of the source are not transferred", adaptors[0].User, adaptors[0].Host, srcArchive)
+	} else {
+		// leftovers of a failed run are removed, as some archivers update an existing archive instead of replacing it
+		cmd, err := utils.RemoveArchiveCommand(srcArchive)
+		if err == nil {
+			_, err = srcExec.Run(cmd)
+		}
+		if err != nil {
+			report.Fail("Skipping %s@%s:%s because removing the old archive failed due to error: %s", adaptors[0].User, adaptors[0].Host, file.Src.Path, err.Error())
+			return
 		}
-	}
-	utils.Log.Tracef("Completed global pre download hooks")
 
-	utils.Log.Tracef("Executing scoped pre download hooks")
-	for _, step := range file.Src.PreDownload {
-		if _, err := conn[file.Src.Adaptor].Run(fmt.Sprintf("cd %s && %s", file.Src.Path, step)); err != nil {
-			utils.Log.Tracef("Error while executing '%s' scoped pre download hook. Error message: %s", step, err.Error())
+		utils.Log.Tracef("Starting to archive %s@%s:%s", adaptors[0].User, adaptors[0].Host, file.Src.Path)
+		if _, err := srcExec.Run(utils.InDir(file.Src.Path, archiver.Create(srcArchive))); err != nil {
+			report.Fail("Skipping %s@%s:%s because archiving failed due to error: %s", adaptors[0].User, adaptors[0].Host, file.Src.Path, err.Error())
+			return
+		}
+		utils.Log.Tracef("Completed archiving %s@%s:%s", adaptors[0].User, adaptors[0].Host, file.Src.Path)
+
+		// checksum of the archive is verified after every copy of it
+		checksum, err := utils.RemoteChecksum(srcExec, srcArchive)
+		if err != nil {
+			report.Fail("Skipping %s@%s:%s because computing checksum failed due to error: %s", adaptors[0].User, adaptors[0].Host, file.Src.Path, err.Error())
+			return
+		}
+		utils.Log.Tracef("Archive %s@%s:%s has sha256 %s", adaptors[0].User, adaptors[0].Host, srcArchive, checksum)
+
+		parts = []utils.Part{{Checksum: checksum}}
+		if file.VolumeSize > 0 {
+			utils.Log.Tracef("Splitting %s@%s:%s into volumes of %s", adaptors[0].User, adaptors[0].Host, srcArchive, file.VolumeSize)
+			list, split, err := utils.SplitArchive(srcExec, srcArchive, archiver, file.VolumeSize)
+			if err != nil {
+				report.Fail("Skipping %s@%s:%s because splitting archive failed due to error: %s", adaptors[0].User, adaptors[0].Host, file.Src.Path, err.Error())
+				return
+			}
+			parts = append([]utils.Part{list}, split...)
 		}
 	}
-	utils.Log.Tracef("Completed scoped pre download hooks")
 
-	// download the file to local staging
-	srcZip := fmt.Sprintf("%s/dump.zip", file.Src.Path)
-	stagerName := utils.GetStagingFileName() + ".zip"
-	destZip := path.Join(os.TempDir(), stagerName)
+	// parts are transferred and verified one by one, the volumes are uploaded while extracting them
+	downloads, uploads := parts, parts
+	if parts[0].Suffix == ".list" {
+		uploads, volumes = parts[:1], parts[1:]
+	}
 
-	// clean the files when the function is over
-	defer os.Remove(destZip)
-	defer utils.Log.Tracef("Removing %s", destZip)
-	defer conn[file.Src.Adaptor].Run(fmt.Sprintf("rm -rf %s", srcZip))
-	defer utils.Log.Tracef("Removing %s@%s:%s", adaptors[0].User, adaptors[0].Host, srcZip)
-	defer conn[file.Src.Adaptor].Run(fmt.Sprintf("rm -rf /tmp/%s", stagerName))
-	defer utils.Log.Tracef("Removing %s@%s:/tmp/%s", adaptors[1].User, adaptors[1].Host, stagerName)
+	if err := utils.RunStage(conn, utils.PostBackup, &file, conf, &data); err != nil {
+		report.Fail("Skipping %s@%s:%s because %s stage failed due to error: %s", adaptors[0].User, adaptors[0].Host, file.Src.Path, utils.PostBackup, err.Error())
+		return
+	}
 
-	utils.Log.Tracef("Downloaded %s@%s:%s to %s in local", adaptors[0].User, adaptors[0].Host, srcZip, destZip)
+	if err := utils.RunStage(conn, utils.PreDownload, &file, conf, &data); err != nil {
+		report.Fail("Skipping %s@%s:%s because %s stage failed due to error: %s", adaptors[0].User, adaptors[0].Host, file.Src.Path, utils.PreDownload, err.Error())
+		return
+	}
+
+	srcStreams := utils.AdaptorStreams(adaptors[0], run.Bandwidth.For(file.Src.Adaptor))
+	destStreams := utils.AdaptorStreams(adaptors[1], run.Bandwidth.For(file.Dest.Adaptor))
 
 	// finally download file to staging
-	if err := conn[file.Src.Adaptor].Download(srcZip, destZip); err != nil {
-		utils.Log.Warnf("Skipping %s@%s:%s because downloading zip failed due to error: %s", adaptors[0].User, adaptors[0].Host, file.Src.Path, err.Error())
+	for _, part := range downloads {
+		src, dst := srcArchive+part.Suffix, localArchive+part.Suffix
+		utils.Log.Tracef("Downloading %s@%s:%s to %s in local", adaptors[0].User, adaptors[0].Host, src, dst)
+
+		download := func() error { return utils.ResumableDownload(srcExec, src, dst, srcStreams) }
+		localChecksum := func() (string, error) { return utils.LocalChecksum(dst) }
+		if err := utils.VerifiedTransfer("download of "+src, part.Checksum, *conf.Settings.Retries, download, localChecksum); err != nil {
+			report.Fail("Skipping %s@%s:%s because downloading archive failed due to error: %s", adaptors[0].User, adaptors[0].Host, file.Src.Path, err.Error())
+			resumable = true
+			return
+		}
+		utils.Log.Tracef("Downloaded %s@%s:%s to %s in local", adaptors[0].User, adaptors[0].Host, src, dst)
+	}
+
+	if err := utils.RunStage(conn, utils.PostDownload, &file, conf, &data); err != nil {
+		report.Fail("Skipping %s@%s:%s because %s stage failed due to error: %s", adaptors[0].User, adaptors[0].Host, file.Src.Path, utils.PostDownload, err.Error())
 		return
 	}
-	utils.Log.Tracef("Downloaded %s@%s:%s to %s in local", adaptors[0].User, adaptors[0].Host, srcZip, destZip)
 
-	utils.Log.Tracef("Executing global post download hooks")
-	for _, step := range conf.Global.Hooks.PostDownload {
-		if _, err := conn[file.Src.Adaptor].Run(step); err != nil {
-			utils.Log.Tracef("Error while executing '%s' global post download hook. Error message: %s", step, err.Error())
-		}
+	// ------ Destination Transfer Begins -------
+	if err := utils.RunStage(conn, utils.PreUpload, &file, conf, &data); err != nil {
+		report.Fail("Skipping %s@%s:%s because %s stage failed due to error: %s", adaptors[1].User, adaptors[1].Host, file.Dest.Path, utils.PreUpload, err.Error())
+		return
 	}
-	utils.Log.Tracef("Completed global post download hooks")
+	report.Dest = fmt.Sprintf("%s@%s:%s", adaptors[1].User, adaptors[1].Host, file.Dest.Path)
 
-	utils.Log.Tracef("Executing scoped post download hooks")
-	for _, step := range file.Src.PostDownload {
-		if _, err := conn[file.Src.Adaptor].Run(fmt.Sprintf("cd %s && %s", file.Src.PostDownload, step)); err != nil {
-			utils.Log.Tracef("Error while executing '%s' scoped post download hook. Error message: %s", step, err.Error())
+	utils.Log.Infof("Restoring %s to %s@%s:%s", localArchive, adaptors[1].User, adaptors[1].Host, file.Dest.Path)
+
+	// upload file to temporary directory
+	for _, part := range uploads {
+		src, dst := localArchive+part.Suffix, destArchive+part.Suffix
+		utils.Log.Tracef("Uploading file from %s of local to %s@%s:%s", src, adaptors[1].User, adaptors[1].Host, dst)
+
+		upload := func() error { return utils.ResumableUpload(destExec, src, dst, destStreams) }
+		destChecksum := func() (string, error) { return utils.RemoteChecksum(destExec, dst) }
+		if err := utils.VerifiedTransfer("upload of "+src, part.Checksum, *conf.Settings.Retries, upload, destChecksum); err != nil {
+			report.Fail("Skipping %s@%s:%s because uploading archive failed due to error: %s", adaptors[1].User, adaptors[1].Host, file.Dest.Path, err.Error())
+			resumable = true
+			return
 		}
+		utils.Log.Tracef("Uploaded file from %s of local to %s@%s:%s", src, adaptors[1].User, adaptors[1].Host, dst)
 	}
-	utils.Log.Tracef("Completed scoped post download hooks")
 
-	// ------ Destination Transfer Begins -------
-	utils.Log.Infof("Restoring %s to %s@%s:%s", destZip, adaptors[1].User, adaptors[1].Host, file.Dest.Path)
+	if err := utils.RunStage(conn, utils.PostUpload, &file, conf, &data); err != nil {
+		report.Fail("Skipping %s@%s:%s because %s stage failed due to error: %s", adaptors[1].User, adaptors[1].Host, file.Dest.Path, utils.PostUpload, err.Error())
+		return
+	}
 
-	utils.Log.Tracef("Executing global pre upload hooks")
-	for _, step := range conf.Global.Hooks.PreUpload {
-		if _, err := conn[file.Dest.Adaptor].Run(step); err != nil {
-			utils.Log.Tracef("Error while executing '%s' global pre upload hook. Error message: %s", step, err.Error())
+	// store the destination, so that a failed restore can be rolled back
+	var snapshot *utils.Snapshot
+	if len(file.Dest.Snapshot) > 0 {
+		utils.Log.Infof("Taking snapshot of %s@%s:%s", adaptors[1].User, adaptors[1].Host, file.Dest.Path)
+		snap, err := utils.TakeSnapshot(destExec, file.Dest.Adaptor, file.Dest, run.ID)
+		if err != nil {
+			report.Fail("Skipping %s@%s:%s because taking snapshot failed due to error: %s", adaptors[1].User, adaptors[1].Host, file.Dest.Path, err.Error())
+			return
 		}
+		if err := run.AddSnapshot(snap); err != nil {
+			report.Warn("Failed to save snapshot of %s@%s:%s for manual rollback due to error: %s", adaptors[1].User, adaptors[1].Host, file.Dest.Path, err.Error())
+		}
+		snapshot = &snap
 	}
-	utils.Log.Tracef("Completed global pre upload hooks")
 
-	utils.Log.Tracef("Executing scoped pre upload hooks")
-	for _, step := range file.Dest.PreUpload {
-		if _, err := conn[file.Dest.Adaptor].Run(step); err != nil {
-			utils.Log.Tracef("Error while executing '%s' scoped pre upload hook. Error message: %s", step, err.Error())
+	// atomic restore extracts into a new release, which is switched live after the post restore hooks
+	var release utils.Release
+	livePath := file.Dest.Path
+
+	// rollback will bring the destination back to the state before restore
+	rollback := func() {
+		if file.Dest.Atomic {
+			if len(release.Dir) > 0 {
+				removeRemote(destExec, file.Dest.Adaptor, release.Dir)
+			}
+			return
+		}
+		if snapshot == nil {
+			return
+		}
+
+		utils.Log.Infof("Rolling back %s@%s:%s from snapshot", adaptors[1].User, adaptors[1].Host, snapshot.Path)
+		if err := snapshot.Restore(destExec); err != nil {
+			report.Warn("Failed to roll back %s@%s:%s due to error: %s", adaptors[1].User, adaptors[1].Host, snapshot.Path, err.Error())
+		} else {
+			report.Warn("%s@%s:%s has been rolled back from snapshot", adaptors[1].User, adaptors[1].Host, snapshot.Path)
 		}
 	}
-	utils.Log.Tracef("Completed scoped pre upload hooks")
 
-	utils.Log.Tracef("Uploading file from %s of local to %s@%s:/tmp/%s", destZip, adaptors[1].User, adaptors[1].Host, stagerName)
-	// upload file to temporary directory
-	if err := conn[file.Dest.Adaptor].Upload(destZip, fmt.Sprintf("/tmp/%s", stagerName)); err != nil {
-		utils.Log.Warnf("Skipping %s@%s:%s because uploading zip failed due to error: %s", adaptors[1].User, adaptors[1].Host, file.Dest.Path, err.Error())
+	if err := utils.RunStage(conn, utils.PreRestore, &file, conf, &data); err != nil {
+		report.Fail("Skipping %s@%s:%s because %s stage failed due to error: %s", adaptors[1].User, adaptors[1].Host, file.Dest.Path, utils.PreRestore, err.Error())
+		rollback()
 		return
 	}
-	utils.Log.Tracef("Uploaded file from %s of local to %s@%s:/tmp/%s", destZip, adaptors[1].User, adaptors[1].Host, stagerName)
 
-	utils.Log.Tracef("Executing global post upload hooks")
-	for _, step := range conf.Global.Hooks.PostUpload {
-		if _, err := conn[file.Dest.Adaptor].Run(step); err != nil {
-			utils.Log.Tracef("Error while executing '%s' global post upload hook. Error message: %s", step, err.Error())
+	if file.Dest.Atomic {
+		release = utils.NewRelease(file.Dest, run.ID)
+		utils.Log.Tracef("Restoring into release %s@%s:%s", adaptors[1].User, adaptors[1].Host, release.Dir)
+		file.Dest.Path, data.Dest.Path = release.Dir, release.Dir
+	}
+
+	// check the existing files on the destination as per the conflict policy, volumes are listed ahead on the source
+	list := archiver.List(destArchive)
+	if len(volumes) > 0 {
+		list = utils.BuildCommand("cat", destArchive+".list")
+	}
+	if file.Dest.Conflict == utils.ConflictFailIfNotEmpty {
+		if empty, err := utils.IsEmptyDir(destExec, file.Dest.Path); err != nil {
+			report.Fail("Skipping %s@%s:%s because checking destination failed due to error: %s", adaptors[1].User, adaptors[1].Host, file.Dest.Path, err.Error())
+			return
+		} else if !empty {
+			report.Fail("Skipping %s@%s:%s because destination is not empty", adaptors[1].User, adaptors[1].Host, file.Dest.Path)
+			return
+		}
+	} else if conflicts, err := utils.FindConflicts(destExec, file.Dest.Path, list); err == nil {
+		for _, conflict := range conflicts {
+			report.Conflicts = append(report.Conflicts, fmt.Sprintf("%s (%s)", conflict, utils.ConflictActions[file.Dest.Conflict]))
+		}
+
+		if file.Dest.Conflict == utils.ConflictBackupThenOverwrite && len(conflicts) > 0 {
+			backup := fmt.Sprintf("%s.syncbit-backup-%s.tar", file.Dest.Path, run.ID)
+			utils.Log.Infof("Backing up %d conflicting files to %s@%s:%s", len(conflicts), adaptors[1].User, adaptors[1].Host, backup)
+			if err := utils.BackupConflicts(destExec, file.Dest.Path, conflicts, backup); err != nil {
+				report.Fail("Skipping %s@%s:%s because backing up conflicting files failed due to error: %s", adaptors[1].User, adaptors[1].Host, file.Dest.Path, err.Error())
+				return
+			}
+		}
+	} else {
+		utils.Log.Tracef("Couldn't find the conflicts on %s@%s:%s. Error message: %s", adaptors[1].User, adaptors[1].Host, file.Dest.Path, err.Error())
+		if file.Dest.Conflict == utils.ConflictBackupThenOverwrite {
+			report.Fail("Skipping %s@%s:%s because conflicting files can't be backed up", adaptors[1].User, adaptors[1].Host, file.Dest.Path)
+			return
 		}
 	}
-	utils.Log.Tracef("Completed global post upload hooks")
 
-	utils.Log.Tracef("Executing scoped post upload hooks")
-	for _, step := range file.Dest.PostUpload {
-		if _, err := conn[file.Dest.Adaptor].Run(step); err != nil {
-			utils.Log.Tracef("Error while executing '%s' scoped post upload hook. Error message: %s", step, err.Error())
+	utils.Log.Tracef("Extracting file from %s@%s:%s to %s@%s:%s", adaptors[1].User, adaptors[1].Host, destArchive, adaptors[1].User, adaptors[1].Host, file.Dest.Path)
+	// extract the temp file to location in Dest.Path
+	var err error
+	if len(volumes) > 0 {
+		err = utils.ExtractVolumes(destExec, file.Dest.Path, archiver.Extract("-", file.Dest.Conflict), localArchive, destArchive, volumes, *conf.Settings.Retries, destStreams)
+	} else {
+		_, err = destExec.Run(utils.ExtractCommand(file.Dest.Path, archiver.Extract(destArchive, file.Dest.Conflict)))
+	}
+	if err != nil {
+		report.Fail("Skipping %s@%s:%s because extracting archive failed due to error: %s", adaptors[1].User, adaptors[1].Host, file.Dest.Path, err.Error())
+		rollback()
+		return
+	}
+	utils.Log.Tracef("Done extracting file from %s@%s:%s to %s@%s:%s", adaptors[1].User, adaptors[1].Host, destArchive, adaptors[1].User, adaptors[1].Host, file.Dest.Path)
+
+	if file.Dest.NeedsOwnership() {
+		utils.Log.Tracef("Applying ownership and permissions on %s@%s:%s", adaptors[1].User, adaptors[1].Host, file.Dest.Path)
+		if err := utils.ApplyOwnership(destExec, file.Dest.Path, file.Dest, owners, data.On(file.Dest.Adaptor, conf)); err != nil {
+			report.Warn("Failed to apply ownership and permissions on %s@%s:%s due to error: %s", adaptors[1].User, adaptors[1].Host, file.Dest.Path, err.Error())
 		}
 	}
-	utils.Log.Tracef("Completed scoped post upload hooks")
 
-	utils.Log.Tracef("Executing global pre restore hooks")
-	for _, step := range conf.Global.Hooks.PreRestore {
-		if _, err := conn[file.Dest.Adaptor].Run(step); err != nil {
-			utils.Log.Tracef("Error while executing '%s' global pre restore hook. Error message: %s", step, err.Error())
+	// compare the restored tree with the source manifest
+	if file.Dest.Verify != utils.VerifyOff {
+		utils.Log.Tracef("Verifying %s@%s:%s against the source manifest", adaptors[1].User, adaptors[1].Host, file.Dest.Path)
+		restored, err := utils.BuildManifest(destExec, file.Dest.Path)
+		if err != nil {
+			report.Differences = append(report.Differences, fmt.Sprintf("couldn't build manifest: %s", err.Error()))
+		} else {
+			report.Differences = manifest.Compare(restored, len(file.Dest.FileMode) == 0)
+		}
+
+		if len(report.Differences) > 0 && file.Dest.Verify == utils.VerifyStrict {
+			report.Fail("Skipping %s@%s:%s because verification found %d differences", adaptors[1].User, adaptors[1].Host, file.Dest.Path, len(report.Differences))
+			rollback()
+			return
 		}
+		if len(report.Differences) > 0 {
+			report.Warn("Verification of %s@%s:%s found %d differences", adaptors[1].User, adaptors[1].Host, file.Dest.Path, len(report.Differences))
+		}
+	}
+
+	if err := utils.RunStage(conn, utils.PostRestore, &file, conf, &data); err != nil {
+		report.Fail("Skipping %s@%s:%s because %s stage failed due to error: %s", adaptors[1].User, adaptors[1].Host, file.Dest.Path, utils.PostRestore, err.Error())
+		rollback()
+		return
 	}
-	utils.Log.Tracef("Completed global pre restore hooks")
 
-	utils.Log.Tracef("Executing scoped pre restore hooks")
-	for _, step := range file.Dest.PreRestore {
-		if _, err := conn[file.Dest.Adaptor].Run(step); err != nil {
-			utils.Log.Tracef("Error while executing '%s' scoped pre restore hook. Error message: %s", step, err.Error())
+	if file.Dest.Atomic {
+		utils.Log.Tracef("Switching %s@%s:%s to %s", adaptors[1].User, adaptors[1].Host, release.Live, release.Dir)
+		if err := release.Activate(destExec); err != nil {
+			report.Fail("Skipping %s@%s:%s because switching release failed due to error: %s", adaptors[1].User, adaptors[1].Host, livePath, err.Error())
+			rollback()
+			return
+		}
+
+		if removed, err := release.Prune(destExec, file.Dest.KeepReleases); err == nil {
+			for _, dir := range removed {
+				utils.Log.Tracef("Removed old release %s@%s:%s", adaptors[1].User, adaptors[1].Host, dir)
+			}
+		} else {
+			report.Warn("Failed to remove old releases of %s@%s:%s due to error: %s", adaptors[1].User, adaptors[1].Host, livePath, err.Error())
 		}
+		file.Dest.Path = livePath
+	}
+
+	report.Success = true
+	utils.Log.Infof("%s@%s:%s has been successfully restored to %s@%s:%s", adaptors[0].User, adaptors[0].Host, file.Src.Path, adaptors[1].User, adaptors[1].Host, file.Dest.Path)
+}
+
+// Rollback will restore the destinations of the run from their snapshots
+func Rollback(id string, conf utils.Config) {
+	run, err := utils.LoadRun(id)
+	if err != nil {
+		utils.Log.Fatalf("Couldn't load run %s: %s", id, err.Error())
 	}
-	utils.Log.Tracef("Completed scoped pre restore hooks")
 
-	utils.Log.Tracef("Unzipping file from %s@%s:/tmp/%s to %s@%s:%s", adaptors[1].User, adaptors[1].Host, stagerName, adaptors[1].User, adaptors[1].Host, file.Dest.Path)
-	// unzip the temp file to location in Dest.Path
-	if _, err := conn[file.Dest.Adaptor].Run(fmt.Sprintf("unzip -o /tmp/%s -d %s", stagerName, file.Dest.Path)); err != nil {
-		utils.Log.Warnf("Skipping %s@%s:%s because uploading zip failed due to error: %s", adaptors[1].User, adaptors[1].Host, file.Dest.Path, err.Error())
+	if len(run.Snapshots) == 0 {
+		utils.Log.Infof("Run %s has no snapshots to roll back", id)
 		return
 	}
-	utils.Log.Tracef("Done unzipping file from %s@%s:/tmp/%s to %s@%s:%s", adaptors[1].User, adaptors[1].Host, stagerName, adaptors[1].User, adaptors[1].Host, file.Dest.Path)
 
-	utils.Log.Tracef("Executing global post restore hooks")
-	for _, step := range conf.Global.Hooks.PostRestore {
-		if _, err := conn[file.Dest.Adaptor].Run(step); err != nil {
-			utils.Log.Tracef("Error while executing '%s' global post restore hook. Error message: %s", step, err.Error())
+	// get ssh connection
+	conn := utils.GetSSHConnections(conf)
+	defer utils.DisconnectSSHConnections(conn)
+
+	for _, snapshot := range run.Snapshots {
+		if _, ok := conn[snapshot.Adaptor]; !ok {
+			utils.Log.Warnf("Skipping %s because adaptor %s is not in the config", snapshot.Path, snapshot.Adaptor)
+			continue
+		}
+
+		utils.Log.Infof("Rolling back %s on %s adaptor", snapshot.Path, snapshot.Adaptor)
+		// the snapshot is restored with the same privilege it was taken with
+		exec := utils.NewExecutor(conn, snapshot.Adaptor, utils.File{Privilege: snapshot.Privilege(conf)}, conf)
+		if err := snapshot.Restore(exec); err != nil {
+			utils.Log.Warnf("Failed to roll back %s on %s adaptor due to error: %s", snapshot.Path, snapshot.Adaptor, err.Error())
+			continue
 		}
+		utils.Log.Infof("%s on %s adaptor has been rolled back", snapshot.Path, snapshot.Adaptor)
 	}
-	utils.Log.Tracef("Completed global post restore hooks")
+}
+
+// probeSize is the size of the file transferred to measure the throughput of an adaptor
+const probeSize = 4 << 20
 
-	utils.Log.Tracef("Executing scoped post restore hooks")
-	for _, step := range file.Dest.PostRestore {
-		if _, err := conn[file.Dest.Adaptor].Run(fmt.Sprintf("cd %s && %s", file.Dest.Path, step)); err != nil {
-			utils.Log.Tracef("Error while executing '%s' scoped post restore hook. Error message: %s", step, err.Error())
+// Estimate will print the size, file count and expected transfer duration of every file, as text or json
+func Estimate(conf utils.Config, format string) {
+	// get ssh connection
+	conn := utils.GetSSHConnections(conf)
+	defer utils.DisconnectSSHConnections(conn)
+
+	// probes are throttled like the transfers of the run
+	bandwidth := utils.NewBandwidth(conf)
+
+	// every adaptor is probed once
+	type probe struct {
+		throughput utils.Throughput
+		err        error
+	}
+	probes := make(map[string]probe)
+	measure := func(file utils.File, source bool) (utils.Throughput, error) {
+		exec := utils.NewFileExecutor(conn, file, source, conf)
+		name := file.Dest.Adaptor
+		if source {
+			name = file.Src.Adaptor
 		}
+
+		if p, ok := probes[name]; ok {
+			return p.throughput, p.err
+		}
+
+		utils.Log.Infof("Probing throughput of %s adaptor", name)
+		streams := utils.AdaptorStreams(utils.GetAdaptorFromName(name, conf), bandwidth.For(name))
+		throughput, err := utils.ProbeThroughput(exec, file.LocalStaging(conf), probeSize, streams)
+		probes[name] = probe{throughput, err}
+		return throughput, err
 	}
-	utils.Log.Tracef("Completed scoped post restore hooks")
 
-	utils.Log.Infof("%s@%s:%s has been successfully restored to %s@%s:%s", adaptors[0].User, adaptors[0].Host, file.Src.Path, adaptors[1].User, adaptors[1].Host, file.Dest.Path)
+	estimations := make([]utils.Estimation, 0, len(conf.Files))
+	for i, file := range conf.Files {
+		estimations = append(estimations, estimateFile(i, file, conn, conf, measure))
+	}
+
+	if format == "json" {
+		printJSON(estimations)
+		return
+	}
+	utils.PrintEstimations(os.Stdout, estimations)
 }
 
-func main() {
-	// get parsed config
-	conf := utils.GetConfig()
+// estimateFile will measure the source of the file and compute the time to download it from the source and upload
+// it to the destination with the measured throughput
+func estimateFile(index int, file utils.File, conn utils.SSHConnections, conf utils.Config, measure func(utils.File, bool) (utils.Throughput, error)) utils.Estimation {
+	estimation := utils.Estimation{File: index, Src: file.Src.Adaptor + ":" + file.Src.Path}
+
+	data := utils.NewTemplateData(file, conf, "estimate", "")
+	if err := data.ExpandPath(&file, true, conf); err != nil {
+		estimation.Err = fmt.Errorf("path depends on hook vars")
+		return estimation
+	}
+
+	src := utils.NewFileExecutor(conn, file, true, conf)
+	if estimation.Size, estimation.Err = utils.EstimateSize(src, file.Src.Path); estimation.Err != nil {
+		return estimation
+	}
+	if estimation.Count, estimation.Err = utils.CountFiles(src, file.Src.Path); estimation.Err != nil {
+		return estimation
+	}
+
+	download, err := measure(file, true)
+	if err != nil {
+		estimation.Err = err
+		return estimation
+	}
+	upload, err := measure(file, false)
+	if err != nil {
+		estimation.Err = err
+		return estimation
+	}
+
+	seconds := float64(estimation.Size)/download.Download + float64(estimation.Size)/upload.Upload
+	estimation.Duration = time.Duration(seconds * float64(time.Second))
+	return estimation
+}
+
+// Plan will print the steps of every file without connecting to the adaptors, as text or json
+func Plan(conf utils.Config, format string) {
+	plans := utils.BuildPlan(conf)
+	if format == "json" {
+		printJSON(plans)
+		return
+	}
+	utils.PrintPlan(os.Stdout, plans)
+}
+
+// Validate will print the summary of the config, it is only reached when the config is valid
+func Validate(conf utils.Config, format string) {
+	summary := struct {
+		Adaptors int `json:"adaptors"`
+		Files    int `json:"files"`
+		Workers  int `json:"workers"`
+	}{len(conf.Adaptors), len(conf.Files), conf.Settings.Workers}
+
+	if format == "json" {
+		printJSON(summary)
+		return
+	}
+	fmt.Printf("Config is valid: %d adaptors, %d files, %d workers\n", summary.Adaptors, summary.Files, summary.Workers)
+}
+
+// TestConnections will connect to every adaptor and print the outcomes, it exits with 1 when any of them failed
+func TestConnections(conf utils.Config, format string) {
+	connections := utils.TestConnections(conf)
+	if format == "json" {
+		printJSON(connections)
+	} else {
+		utils.PrintConnections(os.Stdout, connections)
+	}
+
+	for _, connection := range connections {
+		if connection.Status == utils.CheckFailed {
+			os.Exit(1)
+		}
+	}
+}
+
+// printJSON will write the value as indented json on stdout
+func printJSON(v interface{}) {
+	// placeholders like <run-id> are kept readable
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		utils.Log.Fatalf("Couldn't encode the output: %s", err.Error())
+	}
+}
+
+// Transfer will check every file and transfer the ones passing the checks, in chunks of the workers
+func Transfer(conf utils.Config) {
+	// unique identifier and report of this run
+	run := utils.NewRun()
+	run.Bandwidth = utils.NewBandwidth(conf)
+	utils.Log.Infof("Starting run %s", run.ID)
 
 	// get ssh connection
 	conn := utils.GetSSHConnections(conf)
@@ -210,22 +573,218 @@ func main() {
 	// when this function call complete disconnect all ssh connections
 	defer utils.DisconnectSSHConnections(conn)
 
-	nThreads := cpuid.CPU.ThreadsPerCore * cpuid.CPU.PhysicalCores
-	if nThreads > len(conf.Files) {
-		utils.Log.Infof("Using %d workers", len(conf.Files))
+	// check every file before any transfer, the files failing a check are skipped
+	checks := utils.Preflight(conn, conf)
+	checks.Print(os.Stdout)
+
+	files := make([]utils.File, 0, len(conf.Files))
+	for i, file := range conf.Files {
+		if checks.Failed(i) {
+			report := utils.NewFileReport(file, conf)
+			report.Fail("Skipping %s because preflight checks failed", report.Src)
+			run.Report.Add(report)
+			continue
+		}
+		files = append(files, file)
+	}
+
+	workers := conf.Settings.Workers
+	if workers > len(files) {
+		utils.Log.Infof("Using %d workers", len(files))
 	} else {
-		utils.Log.Infof("Using %d workers", nThreads)
+		utils.Log.Infof("Using %d workers", workers)
 	}
 
-	for _, chunk := range utils.ChunkifyFiles(conf.Files, nThreads) {
+	for _, chunk := range utils.ChunkifyFiles(files, workers) {
 		var wg sync.WaitGroup
 
 		for _, file := range chunk {
 			wg.Add(1)
-			go HandleTransfer(file, conn, &wg, conf)
+			go HandleTransfer(file, conn, &wg, conf, run)
 		}
 
 		wg.Wait()
 	}
 
+	run.Report.Print(os.Stdout)
+}
+
+// Version is the release of syncbit, it is set at build time with -ldflags "-X main.Version=<version>"
+var Version = "dev"
+
+// usage is the help of syncbit, the flags of the command are printed after it
+const usage = `Usage: syncbit [command] [flags] [config]
+
+Commands:
+  run                transfer the files, it is the default command
+  plan               print the steps of every file without executing them
+  validate           check the config and print its summary
+  test-connections   connect to every adaptor and run a command on it
+  estimate           print the size, file count and expected duration of every file
+  rollback <run-id>  restore the destinations from the snapshots of the run
+  version            print the version
+
+The config is looked up from -config flag, SYNCBIT_CONFIG environment variable, the argument and the prompt.
+Run "syncbit <command> -h" to see the flags of the command.
+`
+
+// commands are the names of the subcommands, the first argument is the config of the run command otherwise
+var commands = map[string]bool{"run": true, "plan": true, "validate": true, "test-connections": true, "estimate": true, "rollback": true, "version": true}
+
+// stringList is the flag collecting the values of all its occurrences
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// options hold the flags of a command
+type options struct {
+	flags     *flag.FlagSet
+	overrides utils.Overrides
+	verbose   bool
+	colors    bool
+	format    string
+	files     stringList
+	adaptors  stringList
+}
+
+// newOptions returns the flag set of the command with the config, verbose and colors flags
+func newOptions(command string, args string) *options {
+	o := &options{flags: flag.NewFlagSet(command, flag.ExitOnError)}
+	o.flags.Usage = func() {
+		// run is the default command, so its help is the help of syncbit
+		if command == "run" {
+			fmt.Fprintf(o.flags.Output(), "%s\n", usage)
+		}
+		fmt.Fprintf(o.flags.Output(), "Usage: syncbit %s [flags] %s\n\nFlags:\n", command, args)
+		o.flags.PrintDefaults()
+	}
+
+	o.flags.StringVar(&o.overrides.ConfigFile, "config", "", "path of the config file")
+	o.flags.BoolVar(&o.verbose, "verbose", false, "show the debug logs, overrides verbose setting")
+	o.flags.BoolVar(&o.colors, "colors", false, "show the logs with colors, overrides colors setting")
+	return o
+}
+
+// withFilters will add the flags selecting the files of the config
+func (o *options) withFilters() *options {
+	o.flags.Var(&o.files, "file", "only the files whose source or destination path matches the glob, can be repeated")
+	o.flags.Var(&o.adaptors, "adaptor", "only the files from or to the adaptor, can be repeated")
+	return o
+}
+
+// withWorkers will add the flag of the number of parallel transfers
+func (o *options) withWorkers() *options {
+	o.flags.IntVar(&o.overrides.Workers, "workers", 0, "number of files transferred at the same time, overrides workers setting")
+	return o
+}
+
+// withFormat will add the flag of the output format
+func (o *options) withFormat() *options {
+	o.flags.StringVar(&o.format, "format", "text", "output format, text or json")
+	return o
+}
+
+// parse will parse the flags and return at most max positional args, the settings are overridden only by the
+// given flags
+func (o *options) parse(args []string, max int) []string {
+	// flags can also be given after the positional args, parsing is continued after each one of them
+	var positional []string
+	for {
+		o.flags.Parse(args)
+		remaining := o.flags.Args()
+		if consumed := len(args) - len(remaining); consumed > 0 && args[consumed-1] == "--" {
+			positional = append(positional, remaining...)
+			break
+		}
+		if len(remaining) == 0 {
+			break
+		}
+		positional, args = append(positional, remaining[0]), remaining[1:]
+	}
+
+	if len(positional) > max {
+		fmt.Fprintf(o.flags.Output(), "Unexpected arguments: %s\n", strings.Join(positional[max:], " "))
+		o.flags.Usage()
+		os.Exit(2)
+	}
+
+	o.flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "verbose":
+			o.overrides.Verbose = &o.verbose
+		case "colors":
+			o.overrides.Colors = &o.colors
+		}
+	})
+	o.overrides.Files, o.overrides.Adaptors = o.files, o.adaptors
+
+	if o.format != "" && o.format != "text" && o.format != "json" {
+		utils.Log.Fatalf("Output format %s is not supported, use text or json", o.format)
+	}
+	if o.overrides.Workers < 0 {
+		utils.Log.Fatalf("Workers can't be negative")
+	}
+	return positional
+}
+
+// config will parse the config found from the flags and args
+func (o *options) config(args []string) utils.Config {
+	return utils.GetConfig(args, o.overrides)
+}
+
+func main() {
+	args := os.Args[1:]
+
+	// the run command can be omitted, --dry-run is the same as plan
+	command := "run"
+	if len(args) > 0 && commands[args[0]] {
+		command, args = args[0], args[1:]
+	} else if len(args) > 0 && args[0] == "--dry-run" {
+		command, args = "plan", args[1:]
+	}
+
+	switch command {
+	case "run":
+		o := newOptions(command, "[config]").withFilters().withWorkers()
+		args = o.parse(args, 1)
+		Transfer(o.config(args))
+	case "plan":
+		o := newOptions(command, "[config]").withFilters().withFormat()
+		args = o.parse(args, 1)
+		Plan(o.config(args), o.format)
+	case "validate":
+		o := newOptions(command, "[config]").withFilters().withWorkers().withFormat()
+		args = o.parse(args, 1)
+		Validate(o.config(args), o.format)
+	case "test-connections":
+		o := newOptions(command, "[config]").withFormat()
+		args = o.parse(args, 1)
+		TestConnections(o.config(args), o.format)
+	case "estimate":
+		o := newOptions(command, "[config]").withFilters().withFormat()
+		args = o.parse(args, 1)
+		Estimate(o.config(args), o.format)
+	case "rollback":
+		o := newOptions(command, "<run-id> [config]")
+		args = o.parse(args, 2)
+		if len(args) == 0 {
+			o.flags.Usage()
+			os.Exit(2)
+		}
+		Rollback(args[0], o.config(args[1:]))
+	case "version":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		if flags.Parse(args); flags.NArg() > 0 {
+			fmt.Fprintf(flags.Output(), "Usage: syncbit version\n")
+			os.Exit(2)
+		}
+		fmt.Printf("syncbit %s\n", Version)
+	}
 }
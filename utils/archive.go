@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Archiver builds the commands to create and extract the archive of a directory
+type Archiver interface {
+	// Extension is the file extension of the archive, including the leading dot
+	Extension() string
+	// Create returns the command to archive the current directory into the archive path
+	Create(archive string) string
+	// Extract returns the command to extract the archive into the current directory honouring the conflict policy
+	Extract(archive string, conflict string) string
+	// List returns the command to print the paths inside the archive, one per line
+	List(archive string) string
+	// Unsupported returns the metadata the format can't carry, mapped to the find expression selecting such paths
+	Unsupported() map[string]string
+	// CreateTools are the programs needed on the source to create the archive
+	CreateTools() []string
+	// ExtractTools are the programs needed on the destination to list and extract the archive
+	ExtractTools() []string
+}
+
+// zipArchiver uses zip and unzip, it stores symlinks as links and restores mode bits and mtimes
+type zipArchiver struct{}
+
+// Extension of the zip archive
+func (zipArchiver) Extension() string {
+	return ".zip"
+}
+
+// Create will store the symlinks as links instead of following them
+func (zipArchiver) Create(archive string) string {
+	return BuildCommand("zip", "-q", "-r", "-y", archive, ".")
+}
+
+// Extract will restore setuid, setgid and sticky bits along with the other mode bits
+func (zipArchiver) Extract(archive string, conflict string) string {
+	switch conflict {
+	case ConflictSkipExisting:
+		return BuildCommand("unzip", "-q", "-n", "-K", archive)
+	case ConflictNewerWins:
+		return BuildCommand("unzip", "-q", "-o", "-u", "-K", archive)
+	}
+	return BuildCommand("unzip", "-q", "-o", "-K", archive)
+}
+
+// List will print the entries of zip archive
+func (zipArchiver) List(archive string) string {
+	return BuildCommand("unzip", "-Z1", archive)
+}
+
+// Unsupported metadata of zip format
+func (zipArchiver) Unsupported() map[string]string {
+	return map[string]string{
+		"hardlinked files are stored as separate copies":   "-type f -links +1",
+		"special files (fifo, socket, device) are skipped": `\( -type p -o -type s -o -type b -o -type c \)`,
+	}
+}
+
+// CreateTools of zip format
+func (zipArchiver) CreateTools() []string {
+	return []string{"zip"}
+}
+
+// ExtractTools of zip format
+func (zipArchiver) ExtractTools() []string {
+	return []string{"unzip"}
+}
+
+// tarArchiver uses gzipped tar, it keeps symlinks, hardlinks, mtimes and all the mode bits
+type tarArchiver struct{}
+
+// Extension of the tar archive
+func (tarArchiver) Extension() string {
+	return ".tar.gz"
+}
+
+// Create will archive the directory, excluding the archive itself when it is inside the directory
+func (tarArchiver) Create(archive string) string {
+	return BuildCommand("tar", "-c", "-p", "-z", "-f", archive, "--exclude=./"+path.Base(archive), ".")
+}
+
+// Extract will restore the mode bits, and owners too when executed as root
+func (tarArchiver) Extract(archive string, conflict string) string {
+	switch conflict {
+	case ConflictSkipExisting:
+		return BuildCommand("tar", "-x", "-p", "-z", "--skip-old-files", "-f", archive)
+	case ConflictNewerWins:
+		return BuildCommand("tar", "-x", "-p", "-z", "--keep-newer-files", "-f", archive)
+	}
+	return BuildCommand("tar", "-x", "-p", "-z", "--overwrite", "-f", archive)
+}
+
+// List will print the entries of tar archive
+func (tarArchiver) List(archive string) string {
+	return BuildCommand("tar", "-t", "-z", "-f", archive)
+}
+
+// Unsupported metadata of tar format
+func (tarArchiver) Unsupported() map[string]string {
+	return map[string]string{
+		"sockets are skipped": "-type s",
+	}
+}
+
+// CreateTools of tar format
+func (tarArchiver) CreateTools() []string {
+	return []string{"tar", "gzip"}
+}
+
+// ExtractTools of tar format
+func (tarArchiver) ExtractTools() []string {
+	return []string{"tar", "gzip"}
+}
+
+// ExtractCommand returns the command creating the directory and running the extract command inside it
+func ExtractCommand(dir string, extract string) string {
+	return BuildCommand("mkdir", "-p", dir) + " && " + InDir(dir, extract)
+}
+
+// Archivers are the supported archive formats
+var Archivers = map[string]Archiver{
+	"zip": zipArchiver{},
+	"tar": tarArchiver{},
+}
+
+// GetArchiver returns the archiver of the format, zip is used when format is empty
+func GetArchiver(format string) Archiver {
+	if len(format) == 0 {
+		format = "zip"
+	}
+	return Archivers[format]
+}
+
+// DetectMetadataLoss will count the paths inside the directory whose metadata can't be carried by the archiver
+// The returned warnings are human readable, like "3 hardlinked files are stored as separate copies"
+func DetectMetadataLoss(exec Executor, dir string, archiver Archiver) ([]string, error) {
+	kinds := make([]string, 0)
+	for kind := range archiver.Unsupported() {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	// single command prints the count of each kind on its own line
+	var script strings.Builder
+	for _, kind := range kinds {
+		script.WriteString(fmt.Sprintf("find . %s | wc -l; ", archiver.Unsupported()[kind]))
+	}
+
+	output, err := exec.Run(InDir(dir, script.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	warnings := make([]string, 0)
+	for i, line := range strings.Fields(output) {
+		if count, err := strconv.Atoi(line); err == nil && count > 0 && i < len(kinds) {
+			warnings = append(warnings, fmt.Sprintf("%d %s", count, kinds[i]))
+		}
+	}
+	return warnings, nil
+}
+
+// validateArchive will check the archive format of the files
+func (c *Config) validateArchive() {
+	for i, file := range c.Files {
+		if len(file.Format) > 0 && Archivers[file.Format] == nil {
+			Log.Fatalf("Archive format %s in files[%d] is not supported, use zip or tar", file.Format, i)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ChecksumCommand returns the command printing the sha256 of the file
+func ChecksumCommand(file string) string {
+	return BuildCommand("sha256sum", "--", file)
+}
+
+// RemoteChecksum will compute the hex encoded sha256 of the file on the adaptor
+func RemoteChecksum(exec Executor, file string) (string, error) {
+	output, err := exec.Run(ChecksumCommand(file))
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("sha256sum printed nothing for %s", file)
+	}
+	// escaped file names are prefixed with backslash
+	return strings.TrimPrefix(fields[0], "\\"), nil
+}
+
+// LocalChecksum will compute the hex encoded sha256 of the local file
+func LocalChecksum(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// LocalPrefixChecksum will compute the hex encoded sha256 of the first size bytes of the local file
+func LocalPrefixChecksum(file string, size int64) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.CopyN(hash, f, size); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// RemotePrefixChecksum will compute the hex encoded sha256 of the first size bytes of the file on the adaptor
+func RemotePrefixChecksum(exec Executor, file string, size int64) (string, error) {
+	output, err := exec.Run(BuildCommand("head", "-c", fmt.Sprint(size), "--", file) + " | sha256sum")
+	if err != nil {
+		return "", err
+	}
+
+	var sum string
+	if _, err := fmt.Sscan(output, &sum); err != nil {
+		return "", fmt.Errorf("sha256sum printed nothing for %s", file)
+	}
+	return sum, nil
+}
+
+// VerifiedTransfer will repeat the transfer until the checksum of the copy matches the expected one
+// It gives up after the retries and returns the last error
+func VerifiedTransfer(name string, want string, retries int, transfer func() error, checksum func() (string, error)) error {
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			Log.Warnf("Retrying %s (%d/%d) due to error: %s", name, attempt, retries, err.Error())
+		}
+
+		if err = transfer(); err != nil {
+			continue
+		}
+
+		var got string
+		if got, err = checksum(); err != nil {
+			continue
+		}
+
+		if got != want {
+			err = fmt.Errorf("checksum mismatch, expected sha256 %s but got %s", want, got)
+			continue
+		}
+		return nil
+	}
+	return err
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"github.com/goccy/go-yaml"
+	"github.com/klauspost/cpuid/v2"
 	"io/ioutil"
 	"strings"
 )
@@ -12,6 +13,14 @@ type Settings struct {
 	Verbose bool `yaml:"verbose"`
 	// Colors will add the beautiful distinguishable logs on the stderr
 	Colors bool `yaml:"colors"`
+	// Retries is the number of times a download or upload is repeated when its checksum doesn't match (default: 2)
+	Retries *int `yaml:"retries"`
+	// BandwidthLimit is the bytes per second shared by all the downloads and uploads, like "10M" (default: unlimited)
+	BandwidthLimit Size `yaml:"bandwidth-limit"`
+	// StagingDir is the local directory for the downloaded archives (default: temp directory of the OS)
+	StagingDir string `yaml:"staging-dir"`
+	// Workers is the number of files transferred at the same time (default: number of CPU threads)
+	Workers int `yaml:"workers"`
 }
 
 // Adaptor is the type definition for connection adaptors
@@ -26,26 +35,37 @@ type Adaptor struct {
 	Pass string `yaml:"pass"`
 	// Port is the SSH port to create new connection on (default: 22)
 	Port int `yaml:"port"`
+	// Privilege holds become, become-user and become-password to run the commands on the adaptor through sudo
+	Privilege Become `yaml:",inline"`
+	// Streams is the number of concurrent SFTP sessions transferring the archive from or to the adaptor (default: 1)
+	Streams int `yaml:"streams"`
+	// ChunkSize is the size of the ranges the archive is split into for the streams, like "32M" (default: "32M")
+	ChunkSize Size `yaml:"chunk-size"`
+	// BandwidthLimit is the bytes per second shared by all the transfers from or to the adaptor, like "5M"
+	// (default: unlimited)
+	BandwidthLimit Size `yaml:"bandwidth-limit"`
+	// StagingDir is the absolute directory on the adaptor for the archives and hook scripts (default: "/tmp")
+	StagingDir string `yaml:"staging-dir"`
 }
 
-// Hooks type is used for global hooks
+// Hooks type is used for global hooks and hook sets
 type Hooks struct {
 	// PreBackup will be executed before zipping the directory on the source adaptor
-	PreBackup []string `yaml:"pre-backup"`
+	PreBackup []Hook `yaml:"pre-backup"`
 	// PostBackup will be executed after zipping the directory on the source adaptor
-	PostBackup []string `yaml:"post-backup"`
+	PostBackup []Hook `yaml:"post-backup"`
 	// PreDownload will be executed before downloading the zipped file on the source adaptor
-	PreDownload []string `yaml:"pre-download"`
+	PreDownload []Hook `yaml:"pre-download"`
 	// PostDownload will be executed after downloading the zipped file on the source adaptor
-	PostDownload []string `yaml:"post-download"`
+	PostDownload []Hook `yaml:"post-download"`
 	// PreUpload will be executed before uploading the zip file on the destination adaptor
-	PreUpload []string `yaml:"pre-upload"`
+	PreUpload []Hook `yaml:"pre-upload"`
 	// PostUpload will be executed after uploading the zip file on the destination adaptor
-	PostUpload []string `yaml:"post-upload"`
+	PostUpload []Hook `yaml:"post-upload"`
 	// PreRestore will be executed before unzipping the file on the destination adaptor
-	PreRestore []string `yaml:"pre-restore"`
+	PreRestore []Hook `yaml:"pre-restore"`
 	// PostRestore will be executed after uploading the file on the destination adaptor
-	PostRestore []string `yaml:"post-restore"`
+	PostRestore []Hook `yaml:"post-restore"`
 }
 
 // Global are the top level scope settings for handle transfer function
@@ -61,13 +81,15 @@ type Src struct {
 	// Adaptor is the name of the connection adaptor from adaptors array
 	Adaptor string `yaml:"adaptor"`
 	// PreBackup will be executed before zipping the directory
-	PreBackup []string `yaml:"pre-backup"`
+	PreBackup []Hook `yaml:"pre-backup"`
 	// PostBackup will be executed after zipping the directory
-	PostBackup []string `yaml:"post-backup"`
+	PostBackup []Hook `yaml:"post-backup"`
 	// PreDownload will be executed before downloading the zipped file
-	PreDownload []string `yaml:"pre-download"`
+	PreDownload []Hook `yaml:"pre-download"`
 	// PostDownload will be executed after downloading the zipped file
-	PostDownload []string `yaml:"post-download"`
+	PostDownload []Hook `yaml:"post-download"`
+	// StagingDir overrides the staging directory of the source adaptor for the file
+	StagingDir string `yaml:"staging-dir"`
 }
 
 // Dest is the type definition for destination location
@@ -77,13 +99,44 @@ type Dest struct {
 	// Adaptor is the name of the connection adaptor from adaptors array
 	Adaptor string `yaml:"adaptor"`
 	// PreUpload will be executed before uploading the zip file
-	PreUpload []string `yaml:"pre-upload"`
+	PreUpload []Hook `yaml:"pre-upload"`
 	// PostUpload will be executed after uploading the zip file
-	PostUpload []string `yaml:"post-upload"`
+	PostUpload []Hook `yaml:"post-upload"`
 	// PreRestore will be executed before unzipping the file
-	PreRestore []string `yaml:"pre-restore"`
+	PreRestore []Hook `yaml:"pre-restore"`
 	// PostRestore will be executed after uploading the file
-	PostRestore []string `yaml:"post-restore"`
+	PostRestore []Hook `yaml:"post-restore"`
+	// Conflict is the policy for the files which already exist on the destination (default: "overwrite")
+	// It is one of overwrite, skip-existing, newer-wins, fail-if-not-empty or backup-then-overwrite
+	Conflict string `yaml:"conflict"`
+	// Atomic will extract into a new release directory and switch the live path to it after post-restore hooks
+	Atomic bool `yaml:"atomic"`
+	// Switch is the way the live path is switched to the new release, symlink or rename (default: "symlink")
+	Switch string `yaml:"switch"`
+	// KeepReleases is the number of newest releases to keep on atomic restore (default: 5)
+	KeepReleases int `yaml:"keep-releases"`
+	// Snapshot stores the destination before extraction as archive or copy next to it, and restores it when
+	// extraction or a later fail hook errors. It can also be restored manually with "syncbit rollback <run-id>"
+	Snapshot string `yaml:"snapshot"`
+	// Verify checks the restored files against the manifest of the source, it is one of off, warn or strict
+	// (default: "off"). Missing, extra and mismatching files are reported, strict also fails the file
+	Verify string `yaml:"verify"`
+	// Owner is the user to own all the restored files
+	Owner string `yaml:"owner"`
+	// Group is the group to own all the restored files
+	Group string `yaml:"group"`
+	// FileMode is the octal permission set on all the restored files, for example "0644"
+	FileMode string `yaml:"file-mode"`
+	// DirMode is the octal permission set on all the restored directories, for example "0755"
+	DirMode string `yaml:"dir-mode"`
+	// PreserveOwnership will restore the owner and group of every path as it was on the source
+	PreserveOwnership bool `yaml:"preserve-ownership"`
+	// UserMap translates the source users to destination users, keys and values can be names or uids
+	UserMap map[string]string `yaml:"user-map"`
+	// GroupMap translates the source groups to destination groups, keys and values can be names or gids
+	GroupMap map[string]string `yaml:"group-map"`
+	// StagingDir overrides the staging directory of the destination adaptor for the file
+	StagingDir string `yaml:"staging-dir"`
 }
 
 // File is the type definition for backup files
@@ -93,6 +146,23 @@ type File struct {
 
 	// Dest config contains the details for the restore
 	Dest Dest `yaml:"dest"`
+
+	// Format is the archive format used for the transfer, zip or tar (default: "zip")
+	// zip can't carry hardlinks and special files, tar keeps symlinks, hardlinks, mtimes and all mode bits
+	Format string `yaml:"format"`
+
+	// VolumeSize splits the archive into volumes of the size, like "512M". The volumes are uploaded while they are
+	// being extracted, so the destination needs room for two volumes only. It needs tar format (default: no split)
+	VolumeSize Size `yaml:"volume-size"`
+
+	// StagingDir overrides the local staging directory for the file
+	StagingDir string `yaml:"staging-dir"`
+
+	// HookSets are the names of the hook sets to run for the file, in the given order
+	HookSets []string `yaml:"hook-sets"`
+
+	// Privilege overrides the become settings of both the adaptors for the file
+	Privilege Become `yaml:",inline"`
 }
 
 // Config struct holds the parsed data for of config file
@@ -106,24 +176,38 @@ type Config struct {
 	// Global scoped actions
 	Global Global `yaml:"global"`
 
+	// HookSets are the named reusable hooks, which can be referenced by the files
+	HookSets map[string]Hooks `yaml:"hook-sets"`
+
 	// Files are the directories to zip, download and upload
 	Files []File `yaml:"files"`
 }
 
-// parse is used to read config and unmarshal its contents
-func (c *Config) parse(file string) {
+// parse is used to read config and unmarshal its contents, the overrides are applied before validating it
+func (c *Config) parse(file string, overrides Overrides) {
 	if raw, err := ioutil.ReadFile(file); err == nil {
 		Log.Infof("Parsing %s", file)
 
 		if err := yaml.Unmarshal(raw, c); err != nil {
 			Log.Fatalf(err.Error())
 		}
+		overrides.apply(c)
 		c.validate(file)
+		c.filterFiles(overrides)
 	} else {
 		Log.Fatal(err.Error())
 	}
 }
 
+// trimTrailingSlash will remove the trailing slashes of the path, the root directory is kept as "/"
+func trimTrailingSlash(p string) string {
+	trimmed := strings.TrimRight(p, "/")
+	if len(trimmed) == 0 && len(p) > 0 {
+		return "/"
+	}
+	return trimmed
+}
+
 // validate function is used to validate the user input and add defaults
 func (c *Config) validate(file string) {
 	// enable coloured logging
@@ -137,13 +221,34 @@ func (c *Config) validate(file string) {
 	}
 	Log.Trace("Validating the config file")
 
+	// adding default retries of the transfers
+	if c.Settings.Retries == nil {
+		retries := 2
+		c.Settings.Retries = &retries
+		Log.Tracef("Defaulting retries '%d'", retries)
+	} else if *c.Settings.Retries < 0 {
+		Log.Fatalf("Retries can't be negative")
+	}
+
+	// adding default workers from the cpu threads
+	if c.Settings.Workers < 0 {
+		Log.Fatalf("Workers can't be negative")
+	} else if c.Settings.Workers == 0 {
+		c.Settings.Workers = cpuid.CPU.ThreadsPerCore * cpuid.CPU.PhysicalCores
+		if c.Settings.Workers <= 0 {
+			c.Settings.Workers = 1
+		}
+		Log.Tracef("Defaulting workers '%d'", c.Settings.Workers)
+	}
+
 	// exit when no adaptors are found
 	if len(c.Adaptors) == 0 {
 		Log.Fatal("Couldn't find any adaptor to connect to")
 	}
 
 	// adding defaults to the adaptor fields
-	for _, adaptor := range c.Adaptors {
+	for i := range c.Adaptors {
+		adaptor := &c.Adaptors[i]
 		if len(adaptor.User) == 0 {
 			adaptor.User = "root"
 			Log.Tracef("Defaulting user 'root' for %s adaptor", adaptor.Name)
@@ -158,6 +263,20 @@ func (c *Config) validate(file string) {
 			adaptor.Port = 22
 			Log.Tracef("Defaulting port '22' for %s adaptor", adaptor.Name)
 		}
+
+		if adaptor.Streams <= 0 {
+			adaptor.Streams = 1
+			Log.Tracef("Defaulting streams '1' for %s adaptor", adaptor.Name)
+		}
+
+		if adaptor.ChunkSize <= 0 {
+			adaptor.ChunkSize = 32 << 20
+			Log.Tracef("Defaulting chunk-size '32M' for %s adaptor", adaptor.Name)
+		}
+
+		if len(adaptor.Privilege.User) == 0 {
+			adaptor.Privilege.User = "root"
+		}
 	}
 
 	// exit when there is no file to transfer
@@ -166,7 +285,8 @@ func (c *Config) validate(file string) {
 	}
 
 	// validate adaptor name, paths and fix path trailing /
-	for _, file := range c.Files {
+	for i := range c.Files {
+		file := &c.Files[i]
 		if !c._isValidAdaptor(file.Src.Adaptor) {
 			Log.Fatalf("adaptor name %s is not recognized in files", file.Src.Adaptor)
 		}
@@ -175,23 +295,49 @@ func (c *Config) validate(file string) {
 			Log.Fatalf("adaptor name %s is not recognized in files", file.Src.Adaptor)
 		}
 
+		file.Src.Path = trimTrailingSlash(file.Src.Path)
 		if file.Src.Path == "" {
 			Log.Fatal("Source path is missing")
 		}
 
-		if strings.HasSuffix(file.Src.Path, "/") {
-			file.Src.Path = file.Src.Path[:len(file.Src.Path)-1]
-		}
-
+		file.Dest.Path = trimTrailingSlash(file.Dest.Path)
 		if file.Dest.Path == "" {
 			Log.Fatal("Destination path is missing")
 		}
+	}
 
-		if strings.HasSuffix(file.Dest.Path, "/") {
-			file.Dest.Path = file.Dest.Path[:len(file.Dest.Path)-1]
-		}
+	// merge the referenced hook sets into the scoped hooks
+	c.applyHookSets()
 
-	}
+	// exit when any hook is malformed
+	c.validateHooks()
+
+	// exit when ownership options are malformed
+	c.validateOwnership()
+
+	// exit when archive format is not supported
+	c.validateArchive()
+
+	// exit when staging directories are malformed
+	c.validateStaging()
+
+	// exit when volumes can't be used with the file
+	c.validateVolumes()
+
+	// exit when conflict policy is not supported
+	c.validateConflict()
+
+	// exit when atomic restore options are malformed
+	c.validateRelease()
+
+	// exit when snapshot options are malformed
+	c.validateSnapshot()
+
+	// exit when verification mode is not supported
+	c.validateVerify()
+
+	// exit when any hook or path template is malformed
+	c.validateTemplates()
 }
 
 // _isValidAdaptor is used to check whether the adaptor name is correctly used or not
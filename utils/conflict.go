@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// ConflictOverwrite replaces the existing files on the destination
+	ConflictOverwrite = "overwrite"
+	// ConflictSkipExisting keeps the existing files on the destination
+	ConflictSkipExisting = "skip-existing"
+	// ConflictNewerWins replaces the existing files only when the archived file is newer
+	ConflictNewerWins = "newer-wins"
+	// ConflictFailIfNotEmpty fails the file when the destination has anything in it
+	ConflictFailIfNotEmpty = "fail-if-not-empty"
+	// ConflictBackupThenOverwrite archives the conflicting files next to destination and then replaces them
+	ConflictBackupThenOverwrite = "backup-then-overwrite"
+)
+
+// ConflictActions are the report labels of the conflicting files for every policy
+var ConflictActions = map[string]string{
+	ConflictOverwrite:           "overwritten",
+	ConflictSkipExisting:        "kept",
+	ConflictNewerWins:           "overwritten if older",
+	ConflictFailIfNotEmpty:      "blocked restore",
+	ConflictBackupThenOverwrite: "backed up and overwritten",
+}
+
+// ConflictsCommand returns the command printing the paths of the list command which exist as non directory
+func ConflictsCommand(list string) string {
+	return fmt.Sprintf(`%s | while IFS= read -r f; do if [ -e "$f" ] || [ -L "$f" ]; then [ -d "$f" ] || printf '%%s\n' "$f"; fi; done`, list)
+}
+
+// FindConflicts will list the paths of the archive which already exist as non directory inside dir
+// The list command prints the paths of the archive one per line, like the List command of the archiver
+func FindConflicts(exec Executor, dir string, list string) ([]string, error) {
+	output, err := exec.Run(InDir(dir, ConflictsCommand(list)))
+	if err != nil {
+		return nil, err
+	}
+
+	conflicts := make([]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimPrefix(strings.TrimSpace(line), "./"); len(line) > 0 {
+			conflicts = append(conflicts, line)
+		}
+	}
+	return conflicts, nil
+}
+
+// EmptyDirCommand returns the command printing the first entry of the directory, nothing when it is empty or missing
+func EmptyDirCommand(dir string) string {
+	return fmt.Sprintf("[ ! -d %s ] || ls -A %s | head -n 1", QuotePath(dir), QuotePath(dir))
+}
+
+// IsEmptyDir tells whether the directory is missing or has nothing in it
+func IsEmptyDir(exec Executor, dir string) (bool, error) {
+	output, err := exec.Run(EmptyDirCommand(dir))
+	if err != nil {
+		return false, err
+	}
+	return len(strings.TrimSpace(output)) == 0, nil
+}
+
+// BackupConflicts will archive the conflicting paths of dir into the backup tar file
+func BackupConflicts(exec Executor, dir string, conflicts []string, backup string) error {
+	quoted := make([]string, 0, len(conflicts))
+	for _, p := range conflicts {
+		quoted = append(quoted, Quote(p))
+	}
+
+	// conflicts are appended to the backup in batches, so that the command line doesn't grow too long
+	for i := 0; i < len(quoted); i += 200 {
+		end := i + 200
+		if end > len(quoted) {
+			end = len(quoted)
+		}
+
+		mode := "-r"
+		if i == 0 {
+			mode = "-c"
+		}
+		cmd := fmt.Sprintf("tar %s -f %s -- %s", mode, QuotePath(backup), strings.Join(quoted[i:end], " "))
+		if _, err := exec.Run(InDir(dir, cmd)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateConflict will check the conflict policies of the destinations and add the default
+func (c *Config) validateConflict() {
+	for i := range c.Files {
+		dest := &c.Files[i].Dest
+		if len(dest.Conflict) == 0 {
+			dest.Conflict = ConflictOverwrite
+		}
+
+		if _, ok := ConflictActions[dest.Conflict]; !ok {
+			Log.Fatalf("Conflict policy %s in files[%d] is not supported", dest.Conflict, i)
+		}
+	}
+}
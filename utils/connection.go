@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// Connection is the outcome of connecting to an adaptor
+type Connection struct {
+	// Adaptor is the name of the adaptor
+	Adaptor string `json:"adaptor"`
+	// Target is the user, host and port of the adaptor
+	Target string `json:"target"`
+	// Status is OK or FAILED
+	Status string `json:"status"`
+	// Detail is the remote system when connected, otherwise the reason of the failure
+	Detail string `json:"detail"`
+}
+
+// TestConnections will connect to every adaptor and run a command on it, the failures are reported instead of exiting
+func TestConnections(conf Config) []Connection {
+	connections := make([]Connection, len(conf.Adaptors))
+	var wg sync.WaitGroup
+
+	for i, adaptor := range conf.Adaptors {
+		wg.Add(1)
+		go func(i int, adaptor Adaptor) {
+			defer wg.Done()
+
+			connection := Connection{Adaptor: adaptor.Name, Target: fmt.Sprintf("%s@%s:%d", adaptor.User, adaptor.Host, adaptor.Port), Status: CheckPassed}
+			if detail, err := testConnection(adaptor); err != nil {
+				connection.Status, connection.Detail = CheckFailed, err.Error()
+			} else {
+				connection.Detail = detail
+			}
+			connections[i] = connection
+		}(i, adaptor)
+	}
+	wg.Wait()
+
+	return connections
+}
+
+// testConnection will connect to the adaptor and return its system name
+func testConnection(adaptor Adaptor) (string, error) {
+	cl, err := ConnectAdaptor(adaptor)
+	if err != nil {
+		return "", err
+	}
+	defer cl.Close()
+
+	output, err := cl.Run("uname -s -n")
+	if err != nil {
+		return "", fmt.Errorf("connected but couldn't run a command: %s", err.Error())
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// PrintConnections will write the outcomes of the connections as a table
+func PrintConnections(w io.Writer, connections []Connection) {
+	fmt.Fprintln(w, "Connections:")
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "  ADAPTOR\tTARGET\tSTATUS\tDETAIL")
+	for _, connection := range connections {
+		fmt.Fprintf(table, "  %s\t%s\t%s\t%s\n", connection.Adaptor, connection.Target, connection.Status, connection.Detail)
+	}
+	table.Flush()
+}
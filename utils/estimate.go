@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Throughput is the measured transfer speed between local and the adaptor in bytes per second
+type Throughput struct {
+	// Download is the speed from the adaptor to local
+	Download float64
+	// Upload is the speed from local to the adaptor
+	Upload float64
+}
+
+// Estimation is the size and the expected duration of the transfer of a file
+type Estimation struct {
+	// File is the index of the file in the config
+	File int
+	// Src is the source of the file in adaptor:path form
+	Src string
+	// Size is the disk usage of the source in bytes
+	Size int64
+	// Count is the number of regular files in the source
+	Count int64
+	// Duration is the expected time to download and upload the source, archiving is not included
+	Duration time.Duration
+	// Err is the reason the file can't be estimated
+	Err error
+}
+
+// MarshalJSON encodes the estimation with the duration in seconds and the error as its message
+func (e Estimation) MarshalJSON() ([]byte, error) {
+	out := struct {
+		File    int     `json:"file"`
+		Src     string  `json:"src"`
+		Size    int64   `json:"size"`
+		Count   int64   `json:"count"`
+		Seconds float64 `json:"seconds"`
+		Error   string  `json:"error,omitempty"`
+	}{File: e.File, Src: e.Src, Size: e.Size, Count: e.Count, Seconds: e.Duration.Seconds()}
+	if e.Err != nil {
+		out.Error = e.Err.Error()
+	}
+	return json.Marshal(out)
+}
+
+// CountFiles returns the number of regular files inside the directory
+func CountFiles(exec Executor, dir string) (int64, error) {
+	output, err := exec.Run(InDir(dir, "find . -type f | wc -l"))
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	if _, err := fmt.Sscan(output, &count); err != nil {
+		return 0, fmt.Errorf("malformed file count %q", strings.TrimSpace(output))
+	}
+	return count, nil
+}
+
+// ProbeThroughput will upload and download a probe file of the size through the staging directories, the same way
+// archives are transferred, and measure the speed
+func ProbeThroughput(exec Executor, localDir string, size int64, streams Streams) (Throughput, error) {
+	var throughput Throughput
+
+	probe, err := ioutil.TempFile(localDir, "syncbit-probe-")
+	if err != nil {
+		return throughput, err
+	}
+	defer os.Remove(probe.Name())
+
+	// random contents can't be compressed on the way
+	_, err = io.CopyN(probe, rand.Reader, size)
+	probe.Close()
+	if err != nil {
+		return throughput, err
+	}
+
+	remote := path.Join(exec.Staging, path.Base(probe.Name()))
+	defer func() {
+		if cmd, err := RemoveCommand(remote); err == nil {
+			exec.Run(cmd)
+		}
+	}()
+
+	start := time.Now()
+	if err := ResumableUpload(exec, probe.Name(), remote, streams); err != nil {
+		return throughput, err
+	}
+	throughput.Upload = float64(size) / time.Since(start).Seconds()
+
+	back := probe.Name() + ".back"
+	defer os.Remove(back)
+
+	start = time.Now()
+	if err := ResumableDownload(exec, remote, back, streams); err != nil {
+		return throughput, err
+	}
+	throughput.Download = float64(size) / time.Since(start).Seconds()
+	return throughput, nil
+}
+
+// PrintEstimations will write the estimations as a table followed by the totals
+// The total duration is the sum of all the files, as they share the bandwidth when transferred in parallel
+func PrintEstimations(w io.Writer, estimations []Estimation) {
+	var size, count int64
+	var duration time.Duration
+
+	fmt.Fprintln(w, "Estimation:")
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "  FILE\tSOURCE\tSIZE\tFILES\tETA")
+	for _, e := range estimations {
+		if e.Err != nil {
+			fmt.Fprintf(table, "  files[%d]\t%s\t-\t-\t%s\n", e.File, e.Src, e.Err.Error())
+			continue
+		}
+
+		size, count, duration = size+e.Size, count+e.Count, duration+e.Duration
+		fmt.Fprintf(table, "  files[%d]\t%s\t%s\t%d\t%s\n", e.File, e.Src, Size(e.Size).Human(), e.Count, e.Duration.Round(time.Second))
+	}
+	fmt.Fprintf(table, "  total\t\t%s\t%d\t%s\n", Size(size).Human(), count, duration.Round(time.Second))
+	table.Flush()
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/melbahja/goph"
+	"strings"
+)
+
+// Become holds the privilege escalation settings used to run the commands through sudo
+type Become struct {
+	// Enabled will run the commands through sudo (default: false)
+	Enabled *bool `yaml:"become"`
+	// User is the user to become (default: "root")
+	User string `yaml:"become-user"`
+	// Password is given to sudo on stdin, when empty sudo must not ask for password
+	Password string `yaml:"become-password"`
+}
+
+// Active tells whether the commands should be executed through sudo
+func (b Become) Active() bool {
+	return b.Enabled != nil && *b.Enabled
+}
+
+// Merge returns the copy of the settings overridden by the non empty fields of the override
+func (b Become) Merge(override Become) Become {
+	if override.Enabled != nil {
+		b.Enabled = override.Enabled
+	}
+	if len(override.User) > 0 {
+		b.User = override.User
+	}
+	if len(override.Password) > 0 {
+		b.Password = override.Password
+	}
+	return b
+}
+
+// Runner runs the shell commands on the adaptor
+type Runner interface {
+	// Output will run the command and return its stdout, stderr is included in the error
+	Output(cmd string) (string, error)
+	// OutputWithInput will run the command with the input written to its stdin and return its stdout
+	OutputWithInput(cmd string, input string) (string, error)
+}
+
+// sshRunner runs the commands over the SSH connection
+type sshRunner struct {
+	client *goph.Client
+}
+
+// Output will run the command on a new session
+func (r sshRunner) Output(cmd string) (string, error) {
+	return runOutput(r.client, cmd, "")
+}
+
+// OutputWithInput will run the command on a new session with the input as stdin
+func (r sshRunner) OutputWithInput(cmd string, input string) (string, error) {
+	return runOutput(r.client, cmd, input)
+}
+
+// Executor runs the shell commands on the adaptor as the SSH user or as the become user
+type Executor struct {
+	// Client is the SSH connection of the adaptor, it is used for the SFTP transfers
+	Client *goph.Client
+	// Runner runs the commands, the SSH connection is used when it is nil
+	Runner Runner
+	// Become is the effective privilege escalation setting of the adaptor for the file
+	Become Become
+	// Staging is the directory for the temporary files on the adaptor
+	Staging string
+}
+
+// NewExecutor will create the executor for the adaptor, the become settings of the file override the adaptor ones
+func NewExecutor(conn SSHConnections, name string, file File, conf Config) Executor {
+	executor := Executor{Client: conn[name], Runner: sshRunner{conn[name]}}
+	if adaptor := GetAdaptorFromName(name, conf); adaptor != nil {
+		executor.Become, executor.Staging = adaptor.Privilege, adaptor.StagingDir
+	}
+	executor.Become = executor.Become.Merge(file.Privilege)
+	return executor
+}
+
+// Run will execute the command and return its stdout, stderr is included in the error
+func (e Executor) Run(cmd string) (string, error) {
+	return e.run(cmd, "")
+}
+
+// RunFrom will execute the command with its stdin read from the remote file
+// The file is opened by the SSH user, so it doesn't have to be readable by the become user
+func (e Executor) RunFrom(cmd string, input string) (string, error) {
+	return e.run(cmd, " < "+QuotePath(input))
+}
+
+// run will execute the command, through sudo when become is active, with the redirection appended to it
+func (e Executor) run(cmd string, redirect string) (string, error) {
+	runner := e.Runner
+	if runner == nil {
+		runner = sshRunner{e.Client}
+	}
+
+	if !e.Become.Active() {
+		return runner.Output(cmd + redirect)
+	}
+
+	sudo := fmt.Sprintf("sudo -n -u %s -- sh -c %s", Quote(e.Become.User), Quote(cmd))
+
+	// without password, sudo must not prompt at all
+	if len(e.Become.Password) == 0 {
+		return runner.Output(sudo + redirect)
+	}
+
+	// the password is read from stdin by sudo -v only, which caches the credentials for the session, so the command
+	// runs without a PTY and its stdout is kept apart from the prompt and the lecture printed on stderr
+	return runner.OutputWithInput("sudo -S -p '' -v && "+sudo+redirect, e.Become.Password+"\n")
+}
+
+// runOutput will run the command on client with the input as stdin and return its stdout, stderr is included in the error
+func runOutput(cl *goph.Client, cmd string, input string) (string, error) {
+	sess, err := cl.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer sess.Close()
+
+	var stdout, stderr bytes.Buffer
+	sess.Stdout = &stdout
+	sess.Stderr = &stderr
+	if len(input) > 0 {
+		sess.Stdin = strings.NewReader(input)
+	}
+
+	if err := sess.Run(cmd); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); len(msg) > 0 {
+			return stdout.String(), fmt.Errorf("%w: %s", err, msg)
+		}
+		return stdout.String(), err
+	}
+	return stdout.String(), nil
+}
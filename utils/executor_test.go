@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExecutorRun(t *testing.T) {
+	enabled, disabled := true, false
+	tests := []struct {
+		name       string
+		become     Become
+		redirect   string
+		want       string
+		wantInputs []string
+	}{
+		{"no become", Become{}, "", "cat /etc/hostname", nil},
+		{"become disabled", Become{Enabled: &disabled, User: "root", Password: "secret"}, "", "cat /etc/hostname", nil},
+		{"no password", Become{Enabled: &enabled, User: "www-data"}, "", "sudo -n -u www-data -- sh -c 'cat /etc/hostname'", nil},
+		{"password", Become{Enabled: &enabled, User: "root", Password: "secret"}, "",
+			"sudo -S -p '' -v && sudo -n -u root -- sh -c 'cat /etc/hostname'", []string{"secret\n"}},
+		// the redirection feeds the command, not the sudo reading the password
+		{"password with input", Become{Enabled: &enabled, User: "root", Password: "secret"}, " < /tmp/in",
+			"sudo -S -p '' -v && sudo -n -u root -- sh -c 'cat /etc/hostname' < /tmp/in", []string{"secret\n"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := &fakeRunner{}
+			if _, err := (Executor{Runner: runner, Become: test.become}).run("cat /etc/hostname", test.redirect); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			if want := []string{test.want}; !reflect.DeepEqual(runner.commands, want) {
+				t.Errorf("commands = %q, want %q", runner.commands, want)
+			}
+			if !reflect.DeepEqual(runner.inputs, test.wantInputs) {
+				t.Errorf("inputs = %q, want %q", runner.inputs, test.wantInputs)
+			}
+		})
+	}
+}
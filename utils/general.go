@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/melbahja/goph"
 	"github.com/withmandala/go-log"
@@ -18,17 +20,18 @@ var Log = log.New(os.Stderr).WithTimestamp().WithoutColor()
 type SSHConnections map[string]*goph.Client
 
 // GetConfigFile manages to get the config file path using 3 different lookups
-// The order of search is: SYNCBIT_CONFIG environment variable -> First cli argument -> Input prompt
-func GetConfigFile() string {
+// The order of search is: SYNCBIT_CONFIG environment variable -> First of the args -> Input prompt
+// The prompt is skipped when stdin isn't a terminal
+func GetConfigFile(args []string) string {
 	// get file path from os environment
 	var file = os.Getenv("SYNCBIT_CONFIG")
 
 	// if os env is empty
 	if len(file) == 0 {
 		// get path from argument
-		if len(os.Args) > 1 {
-			file = os.Args[1]
-		} else {
+		if len(args) > 0 {
+			file = args[0]
+		} else if IsTerminal(os.Stdin) {
 			// prompt for config file
 			fmt.Print("Enter config file name: ")
 			fmt.Scanf("%s", &file)
@@ -37,16 +40,24 @@ func GetConfigFile() string {
 			if len(file) == 0 {
 				Log.Fatalf("Config file is required")
 			}
+		} else {
+			Log.Fatalf("Config file is required, pass it with -config flag or SYNCBIT_CONFIG environment variable")
 		}
 	}
 
 	return file
 }
 
-// GetConfig is used to parse the yaml file and return config struct
-func GetConfig() Config {
+// GetConfig is used to parse the yaml file found from the args and return config struct
+// The config file and settings of the overrides take precedence over the lookups and the file
+func GetConfig(args []string, overrides Overrides) Config {
+	file := overrides.ConfigFile
+	if len(file) == 0 {
+		file = GetConfigFile(args)
+	}
+
 	var conf Config
-	conf.parse(GetConfigFile())
+	conf.parse(file, overrides)
 	return conf
 }
 
@@ -54,6 +65,7 @@ func GetConfig() Config {
 func GetSSHConnections(conf Config) SSHConnections {
 	conn := make(SSHConnections)
 	var wg sync.WaitGroup
+	var mutex sync.Mutex
 
 	// iterate all the adaptors
 	Log.Info("Connecting to adaptors")
@@ -62,41 +74,60 @@ func GetSSHConnections(conf Config) SSHConnections {
 		go func(adaptor Adaptor) {
 			defer wg.Done()
 
-			// check for file existence
-			if f, err := os.Stat(adaptor.Pass); err == nil {
-				// if it's directory, stop
-				if f.IsDir() {
-					Log.Fatalf("%s is a directory. Can't open for SSH Key", adaptor.Pass)
-				}
-
-				// create client with ssh key
-				Log.Tracef("Establishing connection for %s", adaptor.Name)
-				if auth, err := goph.Key(adaptor.Pass, ""); err == nil {
-					if cl, err := goph.New(adaptor.User, adaptor.Host, auth); err == nil {
-						Log.Tracef("Connected to %s", adaptor.Name)
-						conn[adaptor.Name] = cl
-					} else {
-						// handle ssh connection failure
-						Log.Fatal(err.Error())
-					}
-				}
-			} else {
-				// create client with password
-				Log.Tracef("Establishing connection for %s", adaptor.Name)
-				if cl, err := goph.New(adaptor.User, adaptor.Host, goph.Password(adaptor.Pass)); err == nil {
-					Log.Tracef("Connected to %s", adaptor.Name)
-					conn[adaptor.Name] = cl
-				} else {
-					// handle ssh connection failure
-					Log.Fatal(err.Error())
-				}
+			cl, err := ConnectAdaptor(adaptor)
+			if err != nil {
+				// handle ssh connection failure
+				Log.Fatal(err.Error())
 			}
+
+			mutex.Lock()
+			conn[adaptor.Name] = cl
+			mutex.Unlock()
 		}(adaptor)
 	}
 	wg.Wait()
 	return conn
 }
 
+// ConnectAdaptor will create the SSH connection to the port of the adaptor, using the pass as private key when it is
+// a file
+func ConnectAdaptor(adaptor Adaptor) (*goph.Client, error) {
+	auth := goph.Password(adaptor.Pass)
+
+	// check for file existence
+	if f, err := os.Stat(adaptor.Pass); err == nil {
+		// if it's directory, stop
+		if f.IsDir() {
+			return nil, fmt.Errorf("%s is a directory. Can't open for SSH Key", adaptor.Pass)
+		}
+
+		if auth, err = goph.Key(adaptor.Pass, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	// host key must be in the known hosts, like goph.New which always dials port 22
+	callback, err := goph.DefaultKnownHosts()
+	if err != nil {
+		return nil, err
+	}
+
+	Log.Tracef("Establishing connection for %s", adaptor.Name)
+	cl, err := goph.NewConn(&goph.Config{
+		User:     adaptor.User,
+		Addr:     adaptor.Host,
+		Port:     uint(adaptor.Port),
+		Auth:     auth,
+		Timeout:  goph.DefaultTimeout,
+		Callback: callback,
+	})
+	if err != nil {
+		return nil, err
+	}
+	Log.Tracef("Connected to %s", adaptor.Name)
+	return cl, nil
+}
+
 // DisconnectSSHConnections will close all the SSH connections
 func DisconnectSSHConnections(conn SSHConnections) {
 	Log.Info("Closing SSH Connection")
@@ -120,10 +151,13 @@ func GetAdaptorFromName(name string, conf Config) *Adaptor {
 	return nil
 }
 
+// init will seed the randomizer once, seeding on every call repeats the names generated within the same second
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
 // GetStagingFileName will generate a random string of 13 chars and return
 func GetStagingFileName() string {
-	// init randomizer
-	rand.Seed(time.Now().Unix())
 	charSet := "abcdedfghijklmnopqrstABCDEFGHIJKLMNOP"
 
 	// make 13 chars long string and return
@@ -136,6 +170,13 @@ func GetStagingFileName() string {
 	return output.String()
 }
 
+// GetResumableStagingName will generate the staging name of the file, it is the same in every run so that partial
+// transfers can be resumed
+func GetResumableStagingName(file File) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{file.Src.Adaptor, file.Src.Path, file.Dest.Adaptor, file.Dest.Path}, "\x00")))
+	return "syncbit-" + hex.EncodeToString(sum[:8])
+}
+
 // ChunkifyFiles will give the chunks of the files array
 func ChunkifyFiles(files []File, limit int) [][]File {
 	batches := make([][]File, 0)
@@ -154,3 +195,8 @@ func ChunkifyFiles(files []File, limit int) [][]File {
 
 	return batches
 }
+
+// GetRunID will generate the unique identifier for the current run from timestamp and random chars
+func GetRunID() string {
+	return fmt.Sprintf("%s-%s", time.Now().Format("20060102-150405"), GetStagingFileName()[:5])
+}
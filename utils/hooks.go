@@ -0,0 +1,432 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Hook is a single step executed on a stage. It can be written as plain command string or as an object
+type Hook struct {
+	// Run is the command to execute on the adaptor of the stage
+	Run string `yaml:"run"`
+	// Local is the command to execute on the machine running syncbit instead of the adaptor
+	Local string `yaml:"local"`
+	// Script is the multi-line script or path of the local script file, uploaded and executed on the adaptor
+	Script string `yaml:"script"`
+	// Interpreter is the program used to execute the script (default: "sh")
+	Interpreter string `yaml:"interpreter"`
+	// When is the condition to run the hook. It is either a template expression like "{{ eq .Src.Host "web1" }}"
+	// or a test command like "test -f wp-config.php" executed at the same place as the hook
+	When string `yaml:"when"`
+	// Unless is the negated form of When, the hook is skipped when the condition is true
+	Unless string `yaml:"unless"`
+	// Cwd is the working directory of the hook, it overrides the default directory of the stage
+	Cwd string `yaml:"cwd"`
+	// Fail will stop the transfer of the file when the hook errors, after extraction it rolls back the destination
+	Fail bool `yaml:"fail"`
+	// Register is the variable name to store the trimmed stdout of the command, available as .Vars.<name>
+	Register string `yaml:"register"`
+}
+
+// UnmarshalYAML will allow hooks to be defined as plain strings as well as objects
+func (h *Hook) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var cmd string
+	if err := unmarshal(&cmd); err == nil {
+		h.Run = cmd
+		return nil
+	}
+
+	// plain type prevents the recursion into this function
+	type plain Hook
+	if err := unmarshal((*plain)(h)); err != nil {
+		return err
+	}
+
+	// script can be the path of a local file, in that case use its contents
+	if len(h.Script) > 0 && !strings.Contains(h.Script, "\n") {
+		if f, err := os.Stat(h.Script); err == nil && !f.IsDir() {
+			raw, err := ioutil.ReadFile(h.Script)
+			if err != nil {
+				return err
+			}
+			h.Script = string(raw)
+		}
+	}
+
+	if len(h.Script) > 0 && len(h.Interpreter) == 0 {
+		h.Interpreter = "sh"
+	}
+	return nil
+}
+
+// Command returns the command or script of the hook irrespective of where it is executed
+func (h Hook) Command() string {
+	if len(h.Local) > 0 {
+		return h.Local
+	}
+	if len(h.Script) > 0 {
+		return h.Script
+	}
+	return h.Run
+}
+
+// templates returns all the fields of the hook which are expanded as template
+func (h Hook) templates() []string {
+	return []string{h.Command(), h.When, h.Unless, h.Cwd}
+}
+
+// Stage is the event of the transfer on which the hooks are executed
+type Stage string
+
+const (
+	// PreBackup is executed before archiving the directory on the source adaptor
+	PreBackup Stage = "pre-backup"
+	// PostBackup is executed after archiving the directory on the source adaptor
+	PostBackup Stage = "post-backup"
+	// PreDownload is executed before downloading the archive from the source adaptor
+	PreDownload Stage = "pre-download"
+	// PostDownload is executed after downloading the archive from the source adaptor
+	PostDownload Stage = "post-download"
+	// PreUpload is executed before uploading the archive to the destination adaptor
+	PreUpload Stage = "pre-upload"
+	// PostUpload is executed after uploading the archive to the destination adaptor
+	PostUpload Stage = "post-upload"
+	// PreRestore is executed before extracting the archive on the destination adaptor
+	PreRestore Stage = "pre-restore"
+	// PostRestore is executed after extracting the archive on the destination adaptor
+	PostRestore Stage = "post-restore"
+)
+
+// Stages are all the stages in the order of execution
+var Stages = []Stage{PreBackup, PostBackup, PreDownload, PostDownload, PreUpload, PostUpload, PreRestore, PostRestore}
+
+// IsSource tells whether the hooks of the stage are executed on the source adaptor
+func (s Stage) IsSource() bool {
+	return s == PreBackup || s == PostBackup || s == PreDownload || s == PostDownload
+}
+
+// String returns the human readable name of the stage for the logs
+func (s Stage) String() string {
+	return strings.ReplaceAll(string(s), "-", " ")
+}
+
+// Get returns the hooks of the stage
+func (h Hooks) Get(stage Stage) []Hook {
+	return map[Stage][]Hook{
+		PreBackup:    h.PreBackup,
+		PostBackup:   h.PostBackup,
+		PreDownload:  h.PreDownload,
+		PostDownload: h.PostDownload,
+		PreUpload:    h.PreUpload,
+		PostUpload:   h.PostUpload,
+		PreRestore:   h.PreRestore,
+		PostRestore:  h.PostRestore,
+	}[stage]
+}
+
+// Hooks returns the scoped hooks of the stage from the source or destination of the file
+func (f File) Hooks(stage Stage) []Hook {
+	return Hooks{
+		PreBackup:    f.Src.PreBackup,
+		PostBackup:   f.Src.PostBackup,
+		PreDownload:  f.Src.PreDownload,
+		PostDownload: f.Src.PostDownload,
+		PreUpload:    f.Dest.PreUpload,
+		PostUpload:   f.Dest.PostUpload,
+		PreRestore:   f.Dest.PreRestore,
+		PostRestore:  f.Dest.PostRestore,
+	}.Get(stage)
+}
+
+// RunStage will execute the global and then the scoped hooks of the stage for the file
+//
+// Hooks are executed on the source adaptor for backup and download stages and on the destination adaptor for upload
+// and restore stages. Global hooks run in the login directory of the SSH user, scoped hooks run in the Src.Path or
+// Dest.Path of the stage. Each hook can override it with cwd. Local hooks run in the current directory of syncbit
+// unless the cwd is given.
+//
+// The path of the stage is expanded after the global hooks, so that it can use the vars registered by them. The error
+// is returned when the path can't be expanded or a hook marked with fail errors, other failed hooks are only logged.
+func RunStage(conn SSHConnections, stage Stage, file *File, conf Config, data *TemplateData) error {
+	return runStage(NewFileExecutor(conn, *file, stage.IsSource(), conf), stage, file, conf, data)
+}
+
+// runStage will execute the hooks of the stage with the executor of the adaptor of the stage
+func runStage(executor Executor, stage Stage, file *File, conf Config, data *TemplateData) error {
+	adaptor := file.Dest.Adaptor
+	if stage.IsSource() {
+		adaptor = file.Src.Adaptor
+	}
+	side := data.On(adaptor, conf)
+
+	Log.Tracef("Executing global %s hooks", stage)
+	for _, hook := range conf.Global.Hooks.Get(stage) {
+		if err := ExecuteHook(executor, hook, "", side); err != nil {
+			Log.Tracef("Error while executing '%s' global %s hook. Error message: %s", hook.Command(), stage, err.Error())
+			if hook.Fail {
+				return fmt.Errorf("global %s hook '%s' failed: %w", stage, hook.Command(), err)
+			}
+		}
+	}
+	Log.Tracef("Completed global %s hooks", stage)
+
+	if err := data.ExpandPath(file, stage.IsSource(), conf); err != nil {
+		return err
+	}
+	side = data.On(adaptor, conf)
+
+	path := file.Dest.Path
+	if stage.IsSource() {
+		path = file.Src.Path
+	} else if hooks := file.Hooks(stage); len(hooks) > 0 {
+		// destination may not exist before the first restore, create it so that scoped hooks can enter it
+		if _, err := executor.Run(BuildCommand("mkdir", "-p", path)); err != nil {
+			Log.Tracef("Error while creating %s for scoped %s hooks. Error message: %s", path, stage, err.Error())
+		}
+	}
+
+	Log.Tracef("Executing scoped %s hooks", stage)
+	for _, hook := range file.Hooks(stage) {
+		if err := ExecuteHook(executor, hook, path, side); err != nil {
+			Log.Tracef("Error while executing '%s' scoped %s hook. Error message: %s", hook.Command(), stage, err.Error())
+			if hook.Fail {
+				return fmt.Errorf("scoped %s hook '%s' failed: %w", stage, hook.Command(), err)
+			}
+		}
+	}
+	Log.Tracef("Completed scoped %s hooks", stage)
+	return nil
+}
+
+// ExecuteHook will expand the hook template, run it on the client inside cwd and register its output
+// Remote hooks use the cwd of the hook when given, otherwise the cwd of the stage. Local hooks only use the cwd of the hook
+func ExecuteHook(executor Executor, hook Hook, cwd string, data TemplateData) error {
+	if len(hook.Cwd) > 0 {
+		dir, err := RenderTemplate(hook.Cwd, data)
+		if err != nil {
+			return err
+		}
+		cwd = dir
+	} else if len(hook.Local) > 0 {
+		cwd = ""
+	}
+
+	// skip the hook when its when or unless condition is not satisfied
+	if len(hook.When) > 0 {
+		if ok, err := checkCondition(executor, hook, hook.When, cwd, data); err != nil {
+			return err
+		} else if !ok {
+			Log.Infof("Skipping '%s' hook because condition '%s' is false", hook.Command(), hook.When)
+			return nil
+		}
+	}
+	if len(hook.Unless) > 0 {
+		if ok, err := checkCondition(executor, hook, hook.Unless, cwd, data); err != nil {
+			return err
+		} else if ok {
+			Log.Infof("Skipping '%s' hook because condition '%s' is true", hook.Command(), hook.Unless)
+			return nil
+		}
+	}
+
+	cmd, err := RenderTemplate(hook.Command(), data)
+	if err != nil {
+		return err
+	}
+
+	var output string
+	if len(hook.Local) > 0 {
+		output, err = runLocal(cmd, cwd, data)
+	} else if len(hook.Script) > 0 {
+		output, err = runScript(executor, cmd, hook.Interpreter, cwd, data)
+	} else {
+		output, err = executor.Run(InDir(cwd, cmd))
+	}
+	if err != nil {
+		return err
+	}
+
+	// vars map is shared by all the copies of the data of the file
+	if len(hook.Register) > 0 {
+		data.Vars[hook.Register] = strings.TrimSpace(output)
+		Log.Tracef("Registered variable %s for '%s' hook", hook.Register, hook.Command())
+	}
+	return nil
+}
+
+// checkCondition will evaluate the condition of the hook
+// A condition wrapped in {{ }} is a template expression, which is false when it expands to "", "false", "0" or "<no value>"
+// Otherwise it is a test command, which is true when it exits with zero status
+func checkCondition(executor Executor, hook Hook, condition string, cwd string, data TemplateData) (bool, error) {
+	expr := strings.TrimSpace(condition)
+	isTemplate := strings.HasPrefix(expr, "{{") && strings.HasSuffix(expr, "}}")
+
+	expanded, err := RenderTemplate(expr, data)
+	if err != nil {
+		return false, err
+	}
+
+	if isTemplate {
+		switch strings.TrimSpace(expanded) {
+		case "", "false", "0", "<no value>":
+			return false, nil
+		}
+		return true, nil
+	}
+
+	// test commands are executed on the same side as the hook
+	if len(hook.Local) > 0 {
+		_, err = runLocal(expanded, cwd, data)
+	} else {
+		_, err = executor.Run(InDir(cwd, expanded))
+	}
+
+	// only the non zero exit status means false, other errors are reported
+	if err != nil {
+		var remoteExit *ssh.ExitError
+		var localExit *exec.ExitError
+		if errors.As(err, &remoteExit) || errors.As(err, &localExit) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// runLocal will run the command with shell on this machine inside cwd and return its stdout, stderr is included in the error
+func runLocal(cmd string, cwd string, data TemplateData) (string, error) {
+	proc := exec.Command("sh", "-c", cmd)
+	proc.Dir = cwd
+	proc.Env = append(os.Environ(), data.Environ()...)
+
+	var stdout, stderr bytes.Buffer
+	proc.Stdout = &stdout
+	proc.Stderr = &stderr
+
+	if err := proc.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); len(msg) > 0 {
+			return stdout.String(), fmt.Errorf("%w: %s", err, msg)
+		}
+		return stdout.String(), err
+	}
+	return stdout.String(), nil
+}
+
+// runScript will upload the script to the remote temp directory, execute it with the interpreter and remove it
+// The script is fed to the interpreter on stdin, so that it is readable by the become user as well
+func runScript(executor Executor, script string, interpreter string, cwd string, data TemplateData) (string, error) {
+	ftp, err := executor.Client.NewSftp()
+	if err != nil {
+		return "", err
+	}
+	defer ftp.Close()
+
+	remote := path.Join(executor.Staging, fmt.Sprintf("syncbit-%s.script", GetStagingFileName()))
+	f, err := ftp.Create(remote)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write([]byte(script)); err != nil {
+		f.Close()
+		return "", err
+	}
+	f.Close()
+
+	// remove the script when it is executed
+	defer ftp.Remove(remote)
+	if err := ftp.Chmod(remote, 0600); err != nil {
+		return "", err
+	}
+
+	return executor.RunFrom(InDir(cwd, exportEnv(data.Environ())+interpreter+" /dev/stdin"), remote)
+}
+
+// fileHooks will return all the global and scoped hooks applicable to the file
+func (c *Config) fileHooks(file File) []Hook {
+	var all []Hook
+	for _, stage := range Stages {
+		all = append(all, c.Global.Hooks.Get(stage)...)
+		all = append(all, file.Hooks(stage)...)
+	}
+	return all
+}
+
+// registeredVars will collect the names of all the variables registered by the hooks of the file
+func (c *Config) registeredVars(file File) map[string]string {
+	vars := make(map[string]string)
+	for _, hook := range c.fileHooks(file) {
+		if len(hook.Register) > 0 {
+			vars[hook.Register] = hook.Register
+		}
+	}
+	return vars
+}
+
+// applyHookSets will merge the hooks of referenced sets into the scoped hooks of every file
+// The execution order of a stage is: global hooks -> hook sets in the listed order -> scoped hooks
+func (c *Config) applyHookSets() {
+	for i := range c.Files {
+		file := &c.Files[i]
+
+		var sets Hooks
+		for _, name := range file.HookSets {
+			set, ok := c.HookSets[name]
+			if !ok {
+				Log.Fatalf("hook set %s is not recognized in files", name)
+			}
+			Log.Tracef("Applying hook set %s to %s", name, file.Src.Path)
+
+			sets.PreBackup = append(sets.PreBackup, set.PreBackup...)
+			sets.PostBackup = append(sets.PostBackup, set.PostBackup...)
+			sets.PreDownload = append(sets.PreDownload, set.PreDownload...)
+			sets.PostDownload = append(sets.PostDownload, set.PostDownload...)
+			sets.PreUpload = append(sets.PreUpload, set.PreUpload...)
+			sets.PostUpload = append(sets.PostUpload, set.PostUpload...)
+			sets.PreRestore = append(sets.PreRestore, set.PreRestore...)
+			sets.PostRestore = append(sets.PostRestore, set.PostRestore...)
+		}
+
+		// set hooks are placed before the scoped hooks of the same stage
+		file.Src.PreBackup = append(sets.PreBackup, file.Src.PreBackup...)
+		file.Src.PostBackup = append(sets.PostBackup, file.Src.PostBackup...)
+		file.Src.PreDownload = append(sets.PreDownload, file.Src.PreDownload...)
+		file.Src.PostDownload = append(sets.PostDownload, file.Src.PostDownload...)
+		file.Dest.PreUpload = append(sets.PreUpload, file.Dest.PreUpload...)
+		file.Dest.PostUpload = append(sets.PostUpload, file.Dest.PostUpload...)
+		file.Dest.PreRestore = append(sets.PreRestore, file.Dest.PreRestore...)
+		file.Dest.PostRestore = append(sets.PostRestore, file.Dest.PostRestore...)
+	}
+}
+
+// validateHooks will check that every hook has exactly one command to execute
+func (c *Config) validateHooks() {
+	for i, file := range c.Files {
+		for _, hook := range c.fileHooks(file) {
+			commands := 0
+			for _, cmd := range []string{hook.Run, hook.Local, hook.Script} {
+				if len(cmd) > 0 {
+					commands++
+				}
+			}
+
+			if commands > 1 {
+				Log.Fatalf("Hook in files[%d] can only have one of run, local or script", i)
+			}
+
+			if commands == 0 {
+				Log.Fatalf("Hook in files[%d] is missing the command to run", i)
+			}
+
+			if len(hook.Interpreter) > 0 && len(hook.Script) == 0 {
+				Log.Fatalf("Hook in files[%d] has interpreter without script", i)
+			}
+		}
+	}
+}
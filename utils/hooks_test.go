@@ -0,0 +1,228 @@
+package utils
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeRunner records the commands instead of running them, commands containing fail return an error and the others
+// return their canned output, if any
+type fakeRunner struct {
+	commands []string
+	inputs   []string
+	outputs  map[string]string
+}
+
+func (f *fakeRunner) Output(cmd string) (string, error) {
+	f.commands = append(f.commands, cmd)
+	if strings.Contains(cmd, "fail") {
+		return "", fmt.Errorf("exit status 1")
+	}
+	if output, ok := f.outputs[cmd]; ok {
+		return output, nil
+	}
+	return "output of " + cmd, nil
+}
+
+func (f *fakeRunner) OutputWithInput(cmd string, input string) (string, error) {
+	f.inputs = append(f.inputs, input)
+	return f.Output(cmd)
+}
+
+// hookConfig returns the config with one global and one scoped hook on every stage
+func hookConfig() (Config, File) {
+	var global, scoped Hooks
+	for _, stage := range Stages {
+		name := strings.ReplaceAll(string(stage), "-", "_")
+		*stageHooks(&global, stage) = []Hook{{Run: "echo global_" + name}}
+		*stageHooks(&scoped, stage) = []Hook{{Run: "echo scoped_" + name}}
+	}
+
+	file := File{
+		Src: Src{Path: "/var/www/site", Adaptor: "old", PreBackup: scoped.PreBackup, PostBackup: scoped.PostBackup,
+			PreDownload: scoped.PreDownload, PostDownload: scoped.PostDownload},
+		Dest: Dest{Path: "/srv/my site", Adaptor: "new", PreUpload: scoped.PreUpload, PostUpload: scoped.PostUpload,
+			PreRestore: scoped.PreRestore, PostRestore: scoped.PostRestore},
+	}
+	conf := Config{
+		Adaptors: []Adaptor{{Name: "old", User: "root", Host: "old.example.com"}, {Name: "new", User: "root", Host: "new.example.com"}},
+		Global:   Global{Hooks: global},
+		Files:    []File{file},
+	}
+	return conf, file
+}
+
+// stageHooks returns the pointer to the hooks of the stage
+func stageHooks(h *Hooks, stage Stage) *[]Hook {
+	return map[Stage]*[]Hook{
+		PreBackup:    &h.PreBackup,
+		PostBackup:   &h.PostBackup,
+		PreDownload:  &h.PreDownload,
+		PostDownload: &h.PostDownload,
+		PreUpload:    &h.PreUpload,
+		PostUpload:   &h.PostUpload,
+		PreRestore:   &h.PreRestore,
+		PostRestore:  &h.PostRestore,
+	}[stage]
+}
+
+func TestRunStageCwd(t *testing.T) {
+	tests := []struct {
+		stage Stage
+		want  []string
+	}{
+		{PreBackup, []string{"echo global_pre_backup", "cd /var/www/site && echo scoped_pre_backup"}},
+		{PostBackup, []string{"echo global_post_backup", "cd /var/www/site && echo scoped_post_backup"}},
+		{PreDownload, []string{"echo global_pre_download", "cd /var/www/site && echo scoped_pre_download"}},
+		{PostDownload, []string{"echo global_post_download", "cd /var/www/site && echo scoped_post_download"}},
+		{PreUpload, []string{"echo global_pre_upload", "mkdir -p '/srv/my site'", "cd '/srv/my site' && echo scoped_pre_upload"}},
+		{PostUpload, []string{"echo global_post_upload", "mkdir -p '/srv/my site'", "cd '/srv/my site' && echo scoped_post_upload"}},
+		{PreRestore, []string{"echo global_pre_restore", "mkdir -p '/srv/my site'", "cd '/srv/my site' && echo scoped_pre_restore"}},
+		{PostRestore, []string{"echo global_post_restore", "mkdir -p '/srv/my site'", "cd '/srv/my site' && echo scoped_post_restore"}},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.stage), func(t *testing.T) {
+			conf, file := hookConfig()
+			data := NewTemplateData(file, conf, "run", "staging")
+			runner := &fakeRunner{}
+
+			if err := runStage(Executor{Runner: runner}, test.stage, &file, conf, &data); err != nil {
+				t.Fatalf("runStage() error = %v", err)
+			}
+			if !reflect.DeepEqual(runner.commands, test.want) {
+				t.Errorf("commands = %q, want %q", runner.commands, test.want)
+			}
+		})
+	}
+}
+
+func TestRunStageWithoutScopedHooks(t *testing.T) {
+	conf, file := hookConfig()
+	file.Dest.PreUpload = nil
+	data := NewTemplateData(file, conf, "run", "staging")
+	runner := &fakeRunner{}
+
+	if err := runStage(Executor{Runner: runner}, PreUpload, &file, conf, &data); err != nil {
+		t.Fatalf("runStage() error = %v", err)
+	}
+
+	// destination is only created for the scoped hooks
+	want := []string{"echo global_pre_upload"}
+	if !reflect.DeepEqual(runner.commands, want) {
+		t.Errorf("commands = %q, want %q", runner.commands, want)
+	}
+}
+
+func TestRunStageCwdOverride(t *testing.T) {
+	conf, file := hookConfig()
+	conf.Global.Hooks.PreBackup = []Hook{{Run: "echo global", Cwd: "/opt/{{ .Adaptor.Name }}"}}
+	file.Src.PreBackup = []Hook{{Run: "echo scoped", Cwd: "~/logs"}}
+	file.Dest.PostRestore = []Hook{{Run: "echo scoped", Cwd: "/srv/{{ .Src.Adaptor }} app"}}
+	data := NewTemplateData(file, conf, "run", "staging")
+
+	tests := []struct {
+		stage Stage
+		want  []string
+	}{
+		{PreBackup, []string{"cd /opt/old && echo global", "cd ~/logs && echo scoped"}},
+		{PostRestore, []string{"echo global_post_restore", "mkdir -p '/srv/my site'", "cd '/srv/old app' && echo scoped"}},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.stage), func(t *testing.T) {
+			runner := &fakeRunner{}
+			if err := runStage(Executor{Runner: runner}, test.stage, &file, conf, &data); err != nil {
+				t.Fatalf("runStage() error = %v", err)
+			}
+			if !reflect.DeepEqual(runner.commands, test.want) {
+				t.Errorf("commands = %q, want %q", runner.commands, test.want)
+			}
+		})
+	}
+}
+
+func TestRunStageExpandsPath(t *testing.T) {
+	conf, file := hookConfig()
+	conf.Global.Hooks.PreUpload = []Hook{{Run: "echo 2021", Register: "year"}}
+	file.Dest.Path = "/srv/{{ .Vars.year }}"
+	data := NewTemplateData(file, conf, "run", "staging")
+	runner := &fakeRunner{}
+
+	if err := runStage(Executor{Runner: runner}, PreUpload, &file, conf, &data); err != nil {
+		t.Fatalf("runStage() error = %v", err)
+	}
+
+	// path uses the var registered by the global hook of the same stage
+	want := []string{"echo 2021", "mkdir -p '/srv/output of echo 2021'", "cd '/srv/output of echo 2021' && echo scoped_pre_upload"}
+	if !reflect.DeepEqual(runner.commands, want) {
+		t.Errorf("commands = %q, want %q", runner.commands, want)
+	}
+	if file.Dest.Path != "/srv/output of echo 2021" || data.Dest.Path != file.Dest.Path {
+		t.Errorf("expanded path = %q and %q", file.Dest.Path, data.Dest.Path)
+	}
+}
+
+func TestRunStageFail(t *testing.T) {
+	tests := []struct {
+		name    string
+		hooks   []Hook
+		want    []string
+		wantErr bool
+	}{
+		{"failure is ignored", []Hook{{Run: "fail"}, {Run: "echo next"}}, []string{"cd /var/www/site && fail", "cd /var/www/site && echo next"}, false},
+		{"failure stops the stage", []Hook{{Run: "fail", Fail: true}, {Run: "echo next"}}, []string{"cd /var/www/site && fail"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conf, file := hookConfig()
+			conf.Global.Hooks.PostBackup = nil
+			file.Src.PostBackup = test.hooks
+			data := NewTemplateData(file, conf, "run", "staging")
+			runner := &fakeRunner{}
+
+			err := runStage(Executor{Runner: runner}, PostBackup, &file, conf, &data)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("runStage() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(runner.commands, test.want) {
+				t.Errorf("commands = %q, want %q", runner.commands, test.want)
+			}
+		})
+	}
+}
+
+func TestExecuteHook(t *testing.T) {
+	conf, file := hookConfig()
+	data := NewTemplateData(file, conf, "run", "staging").On("old", conf)
+
+	tests := []struct {
+		name string
+		hook Hook
+		cwd  string
+		want []string
+	}{
+		{"stage cwd", Hook{Run: "ls"}, "/var/www/site", []string{"cd /var/www/site && ls"}},
+		{"no cwd", Hook{Run: "ls"}, "", []string{"ls"}},
+		{"hook cwd", Hook{Run: "ls", Cwd: "/tmp"}, "/var/www/site", []string{"cd /tmp && ls"}},
+		{"template", Hook{Run: "echo {{ .RunID }} {{ .Adaptor.User }}"}, "", []string{"echo run root"}},
+		{"when template false", Hook{Run: "ls", When: "{{ eq .Adaptor.Name \"new\" }}"}, "", nil},
+		{"when command", Hook{Run: "ls", When: "test -f wp-config.php"}, "/var/www/site", []string{"cd /var/www/site && test -f wp-config.php", "cd /var/www/site && ls"}},
+		{"unless template true", Hook{Run: "ls", Unless: "{{ .Src.Host }}"}, "", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := &fakeRunner{}
+			if err := ExecuteHook(Executor{Runner: runner}, test.hook, test.cwd, data); err != nil {
+				t.Fatalf("ExecuteHook() error = %v", err)
+			}
+			if !reflect.DeepEqual(runner.commands, test.want) {
+				t.Errorf("commands = %q, want %q", runner.commands, test.want)
+			}
+		})
+	}
+}
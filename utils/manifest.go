@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// VerifyOff skips the verification of the restored files
+	VerifyOff = "off"
+	// VerifyWarn reports the differences as warnings
+	VerifyWarn = "warn"
+	// VerifyStrict fails the file when there is any difference
+	VerifyStrict = "strict"
+)
+
+// manifestStatCommand prints size, mode and path of every regular file
+// Records are NUL separated, so that any file name can be parsed
+const manifestStatCommand = `find . -type f -printf '%s %m %p\0'`
+
+// manifestSumCommand prints the sha256 and path of every regular file as NUL separated records
+const manifestSumCommand = `find . -type f -print0 | xargs -0 -r sha256sum -z`
+
+// ManifestEntry holds the metadata of a regular file in the manifest
+type ManifestEntry struct {
+	// Size of the file in bytes
+	Size int64
+	// Mode is the octal permission of the file
+	Mode string
+	// SHA256 is the hex encoded checksum of the contents
+	SHA256 string
+}
+
+// Manifest maps the relative path of every regular file in a directory to its metadata
+type Manifest map[string]ManifestEntry
+
+// BuildManifest will collect path, size, mode and sha256 of every regular file inside the directory on the adaptor
+func BuildManifest(exec Executor, dir string) (Manifest, error) {
+	stats, err := exec.Run(InDir(dir, manifestStatCommand))
+	if err != nil {
+		return nil, err
+	}
+
+	sums, err := exec.Run(InDir(dir, manifestSumCommand))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := make(Manifest)
+	for _, record := range strings.Split(stats, "\x00") {
+		fields := strings.SplitN(record, " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed manifest record %q", record)
+		}
+		manifest[fields[2]] = ManifestEntry{Size: size, Mode: fields[1]}
+	}
+
+	// sha256sum prints "<hash>  <path>" records
+	for _, record := range strings.Split(sums, "\x00") {
+		fields := strings.SplitN(record, "  ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		if entry, ok := manifest[fields[1]]; ok {
+			entry.SHA256 = fields[0]
+			manifest[fields[1]] = entry
+		}
+	}
+	return manifest, nil
+}
+
+// Compare will list the differences of the restored manifest against the source one
+// Mode is only compared when compareMode is set, as file-mode on destination changes it on purpose
+func (m Manifest) Compare(restored Manifest, compareMode bool) []string {
+	differences := make([]string, 0)
+
+	for p, want := range m {
+		got, ok := restored[p]
+		if !ok {
+			differences = append(differences, fmt.Sprintf("missing: %s", p))
+			continue
+		}
+
+		var fields []string
+		if want.Size != got.Size {
+			fields = append(fields, fmt.Sprintf("size %d != %d", got.Size, want.Size))
+		}
+		if want.SHA256 != got.SHA256 {
+			fields = append(fields, "sha256")
+		}
+		if compareMode && want.Mode != got.Mode {
+			fields = append(fields, fmt.Sprintf("mode %s != %s", got.Mode, want.Mode))
+		}
+		if len(fields) > 0 {
+			differences = append(differences, fmt.Sprintf("mismatch: %s (%s)", p, strings.Join(fields, ", ")))
+		}
+	}
+
+	for p := range restored {
+		if _, ok := m[p]; !ok {
+			differences = append(differences, fmt.Sprintf("extra: %s", p))
+		}
+	}
+
+	sort.Strings(differences)
+	return differences
+}
+
+// validateVerify will check the verification mode of the destinations and add the default
+func (c *Config) validateVerify() {
+	for i := range c.Files {
+		dest := &c.Files[i].Dest
+		switch dest.Verify {
+		case "":
+			dest.Verify = VerifyOff
+		case VerifyOff, VerifyWarn, VerifyStrict:
+		default:
+			Log.Fatalf("Verify %s in files[%d] is not supported, use off, warn or strict", dest.Verify, i)
+		}
+	}
+}
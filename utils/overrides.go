@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"golang.org/x/term"
+	"os"
+	"path"
+)
+
+// Overrides are the settings given with the command line flags, they take precedence over the config file
+type Overrides struct {
+	// ConfigFile is the path of the config, it takes precedence over SYNCBIT_CONFIG and the args
+	ConfigFile string
+	// Verbose overrides the verbose setting when it isn't nil
+	Verbose *bool
+	// Colors overrides the colors setting when it isn't nil
+	Colors *bool
+	// Workers overrides the workers setting when it isn't 0
+	Workers int
+	// Files are the glob patterns matched against the source and destination paths and their parents, only the
+	// matching files are kept
+	Files []string
+	// Adaptors are the adaptor names, only the files from or to one of them are kept
+	Adaptors []string
+}
+
+// apply will replace the settings of the config with the given overrides
+func (o Overrides) apply(c *Config) {
+	if o.Verbose != nil {
+		c.Settings.Verbose = *o.Verbose
+	}
+
+	if o.Colors != nil {
+		c.Settings.Colors = *o.Colors
+	}
+
+	if o.Workers != 0 {
+		c.Settings.Workers = o.Workers
+	}
+}
+
+// filterFiles will drop the files not matching the file and adaptor filters of the overrides
+func (c *Config) filterFiles(o Overrides) {
+	if len(o.Files) == 0 && len(o.Adaptors) == 0 {
+		return
+	}
+
+	for _, pattern := range o.Files {
+		if _, err := path.Match(pattern, ""); err != nil {
+			Log.Fatalf("File filter %q is malformed", pattern)
+		}
+	}
+
+	for _, name := range o.Adaptors {
+		if !c._isValidAdaptor(name) {
+			Log.Fatalf("Adaptor filter %s is not recognized", name)
+		}
+	}
+
+	files := make([]File, 0, len(c.Files))
+	for _, file := range c.Files {
+		if matchesAny(o.Files, file.Src.Path, file.Dest.Path) && containsAny(o.Adaptors, file.Src.Adaptor, file.Dest.Adaptor) {
+			files = append(files, file)
+		}
+	}
+
+	if len(files) == 0 {
+		Log.Fatalf("No files match the filters")
+	}
+	Log.Tracef("Kept %d of %d files matching the filters", len(files), len(c.Files))
+	c.Files = files
+}
+
+// matchesAny tells whether any of the paths or their parents matches any of the patterns, no patterns match everything
+func matchesAny(patterns []string, paths ...string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		for _, p := range paths {
+			// "/var/*" selects "/var/www/site" through its parent
+			for ; p != "/" && p != "."; p = path.Dir(p) {
+				if ok, _ := path.Match(pattern, p); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// containsAny tells whether any of the values is one of the items, no items contain everything
+func containsAny(items []string, values ...string) bool {
+	if len(items) == 0 {
+		return true
+	}
+
+	for _, item := range items {
+		for _, value := range values {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsTerminal tells whether the file is an interactive terminal, it is false for pipes and redirected files
+func IsTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// owner is the user and group of a path, both as name and numeric id
+type owner struct {
+	user, group string
+	uid, gid    string
+}
+
+// Ownership holds the owner of every path in the source directory, paths are relative like "./index.php"
+type Ownership map[string]owner
+
+// captureOwnershipCommand prints user, group, uid, gid and path of every path
+// Fields and records are NUL separated, so that any file name can be parsed
+const captureOwnershipCommand = `find . -printf '%u\0%g\0%U\0%G\0%p\0'`
+
+// CaptureOwnership will record the owner of every path inside the directory on the adaptor
+func CaptureOwnership(exec Executor, dir string) (Ownership, error) {
+	output, err := exec.Run(InDir(dir, captureOwnershipCommand))
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Split(output, "\x00")
+	owners := make(Ownership)
+	for i := 0; i+4 < len(fields); i += 5 {
+		owners[fields[i+4]] = owner{user: fields[i], group: fields[i+1], uid: fields[i+2], gid: fields[i+3]}
+	}
+	return owners, nil
+}
+
+// mapOwner will translate the source user or group to the destination one using the mapping table
+// The table can have names or numeric ids as keys, unmapped owners keep their source name
+func mapOwner(table map[string]string, name string, id string) string {
+	if mapped, ok := table[name]; ok {
+		return mapped
+	}
+	if mapped, ok := table[id]; ok {
+		return mapped
+	}
+	return name
+}
+
+// OwnershipScript will build the shell script to apply the ownership and permissions of the destination
+// The script is executed inside the restored directory
+func OwnershipScript(dest Dest, owners Ownership) string {
+	var script strings.Builder
+	script.WriteString("set -e\n")
+
+	// group the paths by their mapped owner, so that chown runs in batches
+	if dest.PreserveOwnership {
+		batches := make(map[string][]string)
+		for p, o := range owners {
+			spec := mapOwner(dest.UserMap, o.user, o.uid) + ":" + mapOwner(dest.GroupMap, o.group, o.gid)
+			batches[spec] = append(batches[spec], p)
+		}
+
+		specs := make([]string, 0, len(batches))
+		for spec := range batches {
+			specs = append(specs, spec)
+		}
+		sort.Strings(specs)
+
+		for _, spec := range specs {
+			paths := batches[spec]
+			sort.Strings(paths)
+			for i := 0; i < len(paths); i += 200 {
+				end := i + 200
+				if end > len(paths) {
+					end = len(paths)
+				}
+
+				quoted := make([]string, 0, end-i)
+				for _, p := range paths[i:end] {
+					quoted = append(quoted, Quote(p))
+				}
+				script.WriteString(fmt.Sprintf("chown -h %s -- %s\n", Quote(spec), strings.Join(quoted, " ")))
+			}
+		}
+	}
+
+	// explicit owner and group override the preserved ones
+	if len(dest.Owner) > 0 || len(dest.Group) > 0 {
+		spec := dest.Owner
+		if len(dest.Group) > 0 {
+			spec += ":" + dest.Group
+		}
+		script.WriteString(fmt.Sprintf("chown -R -h %s .\n", Quote(spec)))
+	}
+
+	if len(dest.FileMode) > 0 {
+		script.WriteString(fmt.Sprintf("find . -type f -exec chmod %s {} +\n", Quote(dest.FileMode)))
+	}
+
+	if len(dest.DirMode) > 0 {
+		script.WriteString(fmt.Sprintf("find . -type d -exec chmod %s {} +\n", Quote(dest.DirMode)))
+	}
+	return script.String()
+}
+
+// NeedsOwnership tells whether any ownership or permission option is set on the destination
+func (d Dest) NeedsOwnership() bool {
+	return d.PreserveOwnership || len(d.Owner) > 0 || len(d.Group) > 0 || len(d.FileMode) > 0 || len(d.DirMode) > 0
+}
+
+// ApplyOwnership will execute the ownership script inside the restored directory on the destination
+func ApplyOwnership(exec Executor, dir string, dest Dest, owners Ownership, data TemplateData) error {
+	_, err := runScript(exec, OwnershipScript(dest, owners), "sh", dir, data)
+	return err
+}
+
+// validateOwnership will check the ownership and permission options of the destinations
+func (c *Config) validateOwnership() {
+	for i, file := range c.Files {
+		for _, mode := range []string{file.Dest.FileMode, file.Dest.DirMode} {
+			if len(mode) == 0 {
+				continue
+			}
+			if v, err := strconv.ParseUint(mode, 8, 32); err != nil || v > 07777 {
+				Log.Fatalf("Mode %s in files[%d] is not a valid octal permission", mode, i)
+			}
+		}
+
+		if (len(file.Dest.UserMap) > 0 || len(file.Dest.GroupMap) > 0) && !file.Dest.PreserveOwnership {
+			Log.Fatalf("user-map and group-map in files[%d] require preserve-ownership", i)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// PlanRunID stands for the run id in the planned paths, the real one is generated when the run starts
+const PlanRunID = "<run-id>"
+
+// Step is a single action of the transfer of a file
+type Step struct {
+	// Stage is the part of the transfer the step belongs to
+	Stage string `json:"stage"`
+	// Adaptor is the name of the adaptor running the step, "local" for the machine running syncbit
+	Adaptor string `json:"adaptor"`
+	// Action is one of run, script, local, download or upload
+	Action string `json:"action"`
+	// Command is the shell command or the script of the step
+	Command string `json:"command,omitempty"`
+	// From is the source path of download and upload steps
+	From string `json:"from,omitempty"`
+	// To is the destination path of download and upload steps
+	To string `json:"to,omitempty"`
+	// Become is the user the command runs as through sudo
+	Become string `json:"become,omitempty"`
+	// When is the condition of the hook, it is skipped when false
+	When string `json:"when,omitempty"`
+	// Unless is the condition of the hook, it is skipped when true
+	Unless string `json:"unless,omitempty"`
+	// Register is the name of the variable storing the output of the hook
+	Register string `json:"register,omitempty"`
+	// Note explains the step when the command depends on the state found during the run
+	Note string `json:"note,omitempty"`
+}
+
+// FilePlan is the ordered list of steps transferring a file
+type FilePlan struct {
+	// File is the index of the file in the config
+	File int `json:"file"`
+	// Src is the source of the file in adaptor:path form
+	Src string `json:"src"`
+	// Dest is the destination of the file in adaptor:path form
+	Dest string `json:"dest"`
+	// Steps are the actions in the order of execution
+	Steps []Step `json:"steps"`
+}
+
+// planner collects the steps of a file
+type planner struct {
+	conf  Config
+	file  File
+	data  TemplateData
+	src   Executor
+	dest  Executor
+	steps []Step
+}
+
+// BuildPlan will resolve the steps of every file the same way the run does, without connecting to any adaptor
+//
+// Vars registered by hooks are shown as "<name>", and the steps depending on the state of the adaptors, like
+// conflicts and snapshots, are described in the note.
+func BuildPlan(conf Config) []FilePlan {
+	plans := make([]FilePlan, 0, len(conf.Files))
+	for i, file := range conf.Files {
+		plans = append(plans, planFile(conf, i, file))
+	}
+	return plans
+}
+
+// planFile will collect the steps of the file in the order of HandleTransfer
+func planFile(conf Config, index int, file File) FilePlan {
+	archiver := GetArchiver(file.Format)
+	staging := NewStagingPaths(file, conf, archiver)
+
+	p := &planner{
+		conf: conf,
+		file: file,
+		data: NewTemplateData(file, conf, PlanRunID, staging.Name),
+		src:  NewFileExecutor(nil, file, true, conf),
+		dest: NewFileExecutor(nil, file, false, conf),
+	}
+	for name := range conf.registeredVars(file) {
+		p.data.Vars[name] = "<" + name + ">"
+	}
+	srcAdaptor, destAdaptor := file.Src.Adaptor, file.Dest.Adaptor
+
+	// backup
+	p.stage(PreBackup)
+	if file.Dest.PreserveOwnership {
+		p.run("backup", true, InDir(p.file.Src.Path, captureOwnershipCommand), "record ownership")
+	}
+	if file.Dest.Verify != VerifyOff {
+		p.run("backup", true, InDir(p.file.Src.Path, manifestStatCommand), "build manifest")
+		p.run("backup", true, InDir(p.file.Src.Path, manifestSumCommand), "build manifest")
+	}
+	p.run("backup", true, KeptArchiveCommand(staging.Src), "when the archive kept by a broken transfer matches, it is reused and the archiving is skipped")
+	if cmd, err := RemoveArchiveCommand(staging.Src); err == nil {
+		p.run("backup", true, cmd, "remove the leftovers of a failed run")
+	}
+	p.run("backup", true, InDir(p.file.Src.Path, archiver.Create(staging.Src)), "")
+	p.run("backup", true, ChecksumCommand(staging.Src), "")
+
+	parts := []string{""}
+	if file.VolumeSize > 0 {
+		p.run("backup", true, SplitCommand(staging.Src, archiver, file.VolumeSize), fmt.Sprintf("split into volumes of %s", file.VolumeSize))
+		parts = []string{".list", VolumeSuffix(0) + " ..."}
+	}
+	p.stage(PostBackup)
+
+	// download
+	p.stage(PreDownload)
+	for _, suffix := range parts {
+		p.add(Step{Stage: "download", Adaptor: srcAdaptor, Action: "download", From: staging.Src + suffix, To: staging.Local + suffix, Note: p.transferNote(srcAdaptor)})
+	}
+	p.stage(PostDownload)
+
+	// upload, volumes are uploaded during the extraction
+	p.stage(PreUpload)
+	p.add(Step{Stage: "upload", Adaptor: destAdaptor, Action: "upload", From: staging.Local + parts[0], To: staging.Dest + parts[0], Note: p.transferNote(destAdaptor)})
+	p.stage(PostUpload)
+
+	// restore
+	if len(file.Dest.Snapshot) > 0 {
+		location, cmd := SnapshotCommand(p.file.Dest, PlanRunID)
+		p.run("restore", false, cmd, fmt.Sprintf("snapshot to %s when destination exists", location))
+	}
+	p.stage(PreRestore)
+
+	livePath := p.file.Dest.Path
+	var release Release
+	if file.Dest.Atomic {
+		release = NewRelease(p.file.Dest, PlanRunID)
+		p.file.Dest.Path = release.Dir
+	}
+
+	list := archiver.List(staging.Dest)
+	if file.VolumeSize > 0 {
+		list = BuildCommand("cat", staging.Dest+".list")
+	}
+	switch file.Dest.Conflict {
+	case ConflictFailIfNotEmpty:
+		p.run("restore", false, EmptyDirCommand(p.file.Dest.Path), "fail when destination is not empty")
+	case ConflictBackupThenOverwrite:
+		p.run("restore", false, InDir(p.file.Dest.Path, ConflictsCommand(list)), fmt.Sprintf("back up the conflicting files to %s.syncbit-backup-%s.tar", p.file.Dest.Path, PlanRunID))
+	default:
+		p.run("restore", false, InDir(p.file.Dest.Path, ConflictsCommand(list)), "report the conflicting files")
+	}
+
+	if file.VolumeSize > 0 {
+		p.run("restore", false, ClearMarkersCommand(staging.Dest), "remove the markers left by a killed run")
+		extract := ExtractCommand(p.file.Dest.Path, archiver.Extract("-", file.Dest.Conflict))
+		p.run("restore", false, extract, "volumes are uploaded one by one and piped into the extraction")
+	} else {
+		p.run("restore", false, ExtractCommand(p.file.Dest.Path, archiver.Extract(staging.Dest, file.Dest.Conflict)), "")
+	}
+
+	if file.Dest.NeedsOwnership() {
+		note := "apply ownership and permissions"
+		if file.Dest.PreserveOwnership {
+			note += ", along with the recorded owner of every path"
+		}
+		p.add(Step{Stage: "restore", Adaptor: destAdaptor, Action: "script", Command: OwnershipScript(p.file.Dest, nil), Become: p.become(p.dest), Note: note})
+	}
+
+	if file.Dest.Verify != VerifyOff {
+		p.run("restore", false, InDir(p.file.Dest.Path, manifestStatCommand), "verify against manifest ("+file.Dest.Verify+")")
+		p.run("restore", false, InDir(p.file.Dest.Path, manifestSumCommand), "verify against manifest ("+file.Dest.Verify+")")
+	}
+	p.stage(PostRestore)
+
+	if file.Dest.Atomic {
+		p.run("restore", false, release.ActivateCommand(), "switch to the new release")
+		p.run("restore", false, "", fmt.Sprintf("remove all but %d newest releases in %s", file.Dest.KeepReleases, release.Releases))
+		p.file.Dest.Path = livePath
+	}
+
+	// cleanup, the staging files are kept with the checksums of the source archive when their transfer breaks
+	note := ""
+	if file.VolumeSize > 0 {
+		note = "along with the list and volumes"
+	}
+	p.add(Step{Stage: "cleanup", Adaptor: "local", Action: "local", Note: strings.TrimSpace("remove " + staging.Local + " " + note)})
+	if cmd, err := RemoveArchiveCommand(staging.Dest); err == nil {
+		p.run("cleanup", false, cmd, "")
+	}
+	if cmd, err := RemoveArchiveCommand(staging.Src); err == nil {
+		p.run("cleanup", true, cmd, "when a download or upload broke, the checksums are saved to "+ChecksumsFile(staging.Src)+" instead")
+	}
+
+	return FilePlan{
+		File:  index,
+		Src:   srcAdaptor + ":" + p.file.Src.Path,
+		Dest:  destAdaptor + ":" + p.file.Dest.Path,
+		Steps: p.steps,
+	}
+}
+
+// add will append the step
+func (p *planner) add(step Step) {
+	p.steps = append(p.steps, step)
+}
+
+// run will append the command running on the source or destination adaptor
+func (p *planner) run(stage string, source bool, cmd string, note string) {
+	adaptor, executor := p.file.Dest.Adaptor, p.dest
+	if source {
+		adaptor, executor = p.file.Src.Adaptor, p.src
+	}
+	p.add(Step{Stage: stage, Adaptor: adaptor, Action: "run", Command: cmd, Become: p.become(executor), Note: note})
+}
+
+// become returns the sudo user of the executor
+func (p *planner) become(executor Executor) string {
+	if executor.Become.Active() {
+		return executor.Become.User
+	}
+	return ""
+}
+
+// transferNote describes the streams and bandwidth limit of the transfers of the adaptor
+func (p *planner) transferNote(name string) string {
+	adaptor := GetAdaptorFromName(name, p.conf)
+	if adaptor == nil {
+		return ""
+	}
+
+	note := fmt.Sprintf("%d streams of %s, verified by sha256", adaptor.Streams, adaptor.ChunkSize)
+	if adaptor.BandwidthLimit > 0 {
+		note += fmt.Sprintf(", limited to %s/s", adaptor.BandwidthLimit)
+	}
+	return note
+}
+
+// stage will append the global and scoped hooks of the stage, like RunStage
+func (p *planner) stage(stage Stage) {
+	adaptor, executor := p.file.Dest.Adaptor, p.dest
+	if stage.IsSource() {
+		adaptor, executor = p.file.Src.Adaptor, p.src
+	}
+
+	for _, hook := range p.conf.Global.Hooks.Get(stage) {
+		p.hook(stage, adaptor, executor, hook, "")
+	}
+
+	if err := p.data.ExpandPath(&p.file, stage.IsSource(), p.conf); err != nil {
+		p.add(Step{Stage: stage.String(), Adaptor: adaptor, Action: "run", Note: "path can't be expanded: " + err.Error()})
+	}
+
+	dir := p.file.Dest.Path
+	if stage.IsSource() {
+		dir = p.file.Src.Path
+	} else if len(p.file.Hooks(stage)) > 0 {
+		p.add(Step{Stage: stage.String(), Adaptor: adaptor, Action: "run", Command: BuildCommand("mkdir", "-p", dir), Become: p.become(executor)})
+	}
+
+	for _, hook := range p.file.Hooks(stage) {
+		p.hook(stage, adaptor, executor, hook, dir)
+	}
+}
+
+// hook will append the hook step, like ExecuteHook
+func (p *planner) hook(stage Stage, adaptor string, executor Executor, hook Hook, cwd string) {
+	data := p.data.On(adaptor, p.conf)
+	step := Step{Stage: stage.String(), Adaptor: adaptor, When: hook.When, Unless: hook.Unless, Register: hook.Register}
+
+	if len(hook.Cwd) > 0 {
+		dir, err := RenderTemplate(hook.Cwd, data)
+		if err != nil {
+			step.Note = "cwd can't be expanded: " + err.Error()
+		}
+		cwd = dir
+	} else if len(hook.Local) > 0 {
+		cwd = ""
+	}
+
+	cmd, err := RenderTemplate(hook.Command(), data)
+	if err != nil {
+		step.Note = "command can't be expanded: " + err.Error()
+	}
+
+	switch {
+	case len(hook.Local) > 0:
+		step.Adaptor, step.Action, step.Command = "local", "local", InDir(cwd, cmd)
+	case len(hook.Script) > 0:
+		step.Action, step.Command, step.Become = "script", cmd, p.become(executor)
+		step.Note = strings.TrimSpace(step.Note + " run with " + hook.Interpreter)
+		if len(cwd) > 0 {
+			step.Note += " in " + cwd
+		}
+	default:
+		step.Action, step.Command, step.Become = "run", InDir(cwd, cmd), p.become(executor)
+	}
+	p.add(step)
+}
+
+// PrintPlan will write the steps of every file in human readable form
+func PrintPlan(w io.Writer, plans []FilePlan) {
+	for _, plan := range plans {
+		fmt.Fprintf(w, "files[%d] %s -> %s\n", plan.File, plan.Src, plan.Dest)
+		for i, step := range plan.Steps {
+			target := step.Adaptor
+			if len(step.Become) > 0 {
+				target += " as " + step.Become
+			}
+
+			fmt.Fprintf(w, "  %2d. [%s] %s %s", i+1, step.Stage, target, step.Action)
+			switch {
+			case len(step.From) > 0:
+				fmt.Fprintf(w, " %s -> %s", step.From, step.To)
+			case strings.Contains(step.Command, "\n"):
+				fmt.Fprintf(w, ":\n      %s", strings.ReplaceAll(strings.TrimSpace(step.Command), "\n", "\n      "))
+			case len(step.Command) > 0:
+				fmt.Fprintf(w, ": %s", step.Command)
+			}
+			fmt.Fprintln(w)
+
+			for _, extra := range [][2]string{{"when", step.When}, {"unless", step.Unless}, {"register", step.Register}, {"note", step.Note}} {
+				if len(extra[1]) > 0 {
+					fmt.Fprintf(w, "      %s: %s\n", extra[0], extra[1])
+				}
+			}
+		}
+	}
+}
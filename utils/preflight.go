@@ -0,0 +1,288 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	// CheckPassed is the status of the successful check
+	CheckPassed = "OK"
+	// CheckFailed is the status of the check which found a problem, the file is skipped
+	CheckFailed = "FAILED"
+	// CheckSkipped is the status of the check which can't be done before the transfer
+	CheckSkipped = "SKIPPED"
+)
+
+// Check is the outcome of a single preflight check of a file
+type Check struct {
+	// File is the index of the file in the config
+	File int
+	// Name is the short description of the check
+	Name string
+	// Target is the adaptor and path being checked
+	Target string
+	// Status is one of OK, FAILED or SKIPPED
+	Status string
+	// Detail explains the outcome of the check
+	Detail string
+}
+
+// Checks are the outcomes of the preflight checks of all the files
+type Checks []Check
+
+// Failed tells whether any check of the file at the index has failed
+func (c Checks) Failed(file int) bool {
+	for _, check := range c {
+		if check.File == file && check.Status == CheckFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// Print will write the checks as a table
+func (c Checks) Print(w io.Writer) {
+	fmt.Fprintln(w, "Preflight checks:")
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "  FILE\tCHECK\tTARGET\tSTATUS\tDETAIL")
+	for _, check := range c {
+		fmt.Fprintf(table, "  files[%d]\t%s\t%s\t%s\t%s\n", check.File, check.Name, check.Target, check.Status, check.Detail)
+	}
+	table.Flush()
+}
+
+// Preflight will check every file before the run, so that missing paths, tools, permissions and free space are
+// found before any archive is created
+//
+// Paths using the vars registered by hooks can't be expanded before the transfer, their checks are skipped.
+func Preflight(conn SSHConnections, conf Config) Checks {
+	checks := make(Checks, 0)
+	for i, file := range conf.Files {
+		checks = append(checks, preflightFile(conn, conf, i, file)...)
+	}
+	return checks
+}
+
+// preflightFile will run all the checks of the file
+func preflightFile(conn SSHConnections, conf Config, index int, file File) Checks {
+	src, dest := NewFileExecutor(conn, file, true, conf), NewFileExecutor(conn, file, false, conf)
+	archiver := GetArchiver(file.Format)
+	local := file.LocalStaging(conf)
+
+	checks := make(Checks, 0)
+	add := func(name string, target string, detail string, err error) {
+		check := Check{File: index, Name: name, Target: target, Status: CheckPassed, Detail: detail}
+		if err != nil {
+			check.Status, check.Detail = CheckFailed, err.Error()
+		}
+		checks = append(checks, check)
+	}
+	skip := func(name string, target string, reason string) {
+		checks = append(checks, Check{File: index, Name: name, Target: target, Status: CheckSkipped, Detail: reason})
+	}
+
+	data := NewTemplateData(file, conf, "preflight", "")
+	srcErr, destErr := data.ExpandPath(&file, true, conf), data.ExpandPath(&file, false, conf)
+	srcTarget, destTarget := file.Src.Adaptor+":"+file.Src.Path, file.Dest.Adaptor+":"+file.Dest.Path
+
+	readable := false
+	if srcErr != nil {
+		skip("source readable", srcTarget, "path depends on hook vars")
+	} else {
+		err := testCommand(src, fmt.Sprintf("[ -d %s ] && [ -r %s ] && [ -x %s ]", QuotePath(file.Src.Path), QuotePath(file.Src.Path), QuotePath(file.Src.Path)), "doesn't exist or isn't readable")
+		add("source readable", srcTarget, "", err)
+		readable = err == nil
+	}
+
+	if destErr != nil {
+		skip("destination writable", destTarget, "path depends on hook vars")
+	} else {
+		add("destination writable", destTarget, "", testCommand(dest, nearestExisting(file.Dest.Path)+`[ -d "$d" ] && [ -w "$d" ]`, "isn't writable"))
+	}
+
+	add("source tools", file.Src.Adaptor, "", checkTools(src, sourceTools(file, archiver)))
+	add("destination tools", file.Dest.Adaptor, "", checkTools(dest, destTools(file, archiver)))
+
+	add("source staging", file.Src.Adaptor+":"+src.Staging, "", CheckStaging(src, src.Staging))
+	add("local staging", "local:"+local, "", CheckLocalStaging(local))
+	add("destination staging", file.Dest.Adaptor+":"+dest.Staging, "", CheckStaging(dest, dest.Staging))
+
+	if !readable {
+		skip("free space", srcTarget, "size of the source is unknown")
+		return checks
+	}
+
+	size, err := EstimateSize(src, file.Src.Path)
+	if err != nil {
+		add("free space", srcTarget, "", err)
+		return checks
+	}
+
+	localRun := func(cmd string) (string, error) { return runLocal(cmd, "", TemplateData{}) }
+
+	// compressed archive is expected to be smaller than the directory
+	detail, err := checkSpace(src.Run, []need{{src.Staging, size}})
+	add("source free space", file.Src.Adaptor+":"+src.Staging, detail, err)
+
+	detail, err = checkSpace(localRun, []need{{local, size}})
+	add("local free space", "local:"+local, detail, err)
+
+	// only two volumes are kept on the destination at a time
+	staging := size
+	if file.VolumeSize > 0 && 2*int64(file.VolumeSize) < size {
+		staging = 2 * int64(file.VolumeSize)
+	}
+	needs := []need{{dest.Staging, staging}}
+	if destErr == nil {
+		needs = append(needs, need{file.Dest.Path, size})
+	}
+	detail, err = checkSpace(dest.Run, needs)
+	add("destination free space", destTarget, detail, err)
+
+	return checks
+}
+
+// EstimateSize returns the disk usage of the directory in bytes
+func EstimateSize(exec Executor, dir string) (int64, error) {
+	output, err := exec.Run(BuildCommand("du", "-s", "-k", "--", dir))
+	if err != nil {
+		return 0, err
+	}
+
+	var kilobytes int64
+	if _, err := fmt.Sscan(output, &kilobytes); err != nil {
+		return 0, fmt.Errorf("malformed du output %q", strings.TrimSpace(output))
+	}
+	return kilobytes * 1024, nil
+}
+
+// testCommand will run the test expression and return the error with the detail when it is false
+func testCommand(exec Executor, test string, detail string) error {
+	output, err := exec.Run(fmt.Sprintf("%s && echo yes || echo no", test))
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(output) != "yes" {
+		return fmt.Errorf("%s", detail)
+	}
+	return nil
+}
+
+// nearestExisting returns the shell snippet setting $d to the path or to its nearest existing parent
+func nearestExisting(p string) string {
+	return fmt.Sprintf(`d=%s; while [ ! -e "$d" ]; do d=$(dirname "$d"); done; `, QuotePath(p))
+}
+
+// checkTools will return the error listing the programs missing on the adaptor
+func checkTools(exec Executor, tools []string) error {
+	quoted := make([]string, 0, len(tools))
+	for _, tool := range tools {
+		quoted = append(quoted, Quote(tool))
+	}
+
+	output, err := exec.Run(fmt.Sprintf(`for t in %s; do command -v "$t" >/dev/null 2>&1 || printf '%%s ' "$t"; done`, strings.Join(quoted, " ")))
+	if err != nil {
+		return err
+	}
+
+	if missing := strings.Fields(output); len(missing) > 0 {
+		return fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// sourceTools returns the programs used on the source adaptor for the file
+func sourceTools(file File, archiver Archiver) []string {
+	tools := append([]string{"find", "sha256sum", "head", "du", "df"}, archiver.CreateTools()...)
+	if file.VolumeSize > 0 {
+		tools = append(tools, "split")
+	}
+	if file.Dest.Verify != VerifyOff {
+		tools = append(tools, "xargs")
+	}
+	return uniqueStrings(tools)
+}
+
+// destTools returns the programs used on the destination adaptor for the file
+func destTools(file File, archiver Archiver) []string {
+	tools := append([]string{"find", "sha256sum", "head", "df"}, archiver.ExtractTools()...)
+	if file.Dest.Verify != VerifyOff {
+		tools = append(tools, "xargs")
+	}
+	if file.Dest.Snapshot == SnapshotArchive || file.Dest.Conflict == ConflictBackupThenOverwrite {
+		tools = append(tools, "tar", "gzip")
+	}
+	if file.Dest.Snapshot == SnapshotCopy {
+		tools = append(tools, "cp")
+	}
+	if file.Dest.NeedsOwnership() {
+		tools = append(tools, "chown", "chmod")
+	}
+	return uniqueStrings(tools)
+}
+
+// uniqueStrings returns the items without the repeated ones, keeping their order
+func uniqueStrings(items []string) []string {
+	seen := make(map[string]bool)
+	unique := make([]string, 0, len(items))
+	for _, item := range items {
+		if !seen[item] {
+			seen[item] = true
+			unique = append(unique, item)
+		}
+	}
+	return unique
+}
+
+// need is the space required in the directory
+type need struct {
+	dir  string
+	size int64
+}
+
+// checkSpace will compare the needed space with the free space, the needs on the same filesystem are summed up
+// It returns the detail of the required and free space of every filesystem
+func checkSpace(run func(string) (string, error), needs []need) (string, error) {
+	required, free := make(map[string]int64), make(map[string]int64)
+	for _, n := range needs {
+		output, err := run(nearestExisting(n.dir) + `df -P -k "$d" | tail -n 1`)
+		if err != nil {
+			return "", err
+		}
+
+		// Filesystem 1024-blocks Used Available Capacity Mounted on
+		fields := strings.Fields(output)
+		if len(fields) < 6 {
+			return "", fmt.Errorf("malformed df output %q", strings.TrimSpace(output))
+		}
+		available, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("malformed df output %q", strings.TrimSpace(output))
+		}
+
+		mount := strings.Join(fields[5:], " ")
+		required[mount] += n.size
+		free[mount] = available * 1024
+	}
+
+	mounts := make([]string, 0, len(required))
+	for mount := range required {
+		mounts = append(mounts, mount)
+	}
+	sort.Strings(mounts)
+
+	details := make([]string, 0, len(mounts))
+	for _, mount := range mounts {
+		if required[mount] > free[mount] {
+			return "", fmt.Errorf("%s needs %s but %s is free", mount, Size(required[mount]).Human(), Size(free[mount]).Human())
+		}
+		details = append(details, fmt.Sprintf("%s needs %s of %s free", mount, Size(required[mount]).Human(), Size(free[mount]).Human()))
+	}
+	return strings.Join(details, ", "), nil
+}
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// SwitchSymlink points the "current" symlink inside Dest.Path to the new release
+	SwitchSymlink = "symlink"
+	// SwitchRename moves the new release in place of Dest.Path
+	SwitchRename = "rename"
+)
+
+// Release holds the directories of an atomic restore
+type Release struct {
+	// Dir is the directory where the archive is extracted
+	Dir string
+	// Live is the path serving the site, it is switched to Dir on activation
+	Live string
+	// Releases is the directory holding all the releases
+	Releases string
+	// Switch is the way Live is pointed to Dir, symlink or rename
+	Switch string
+}
+
+// NewRelease will build the release directories of the destination for the run
+//
+// With symlink switch the layout is Dest.Path/releases/<run-id> and Dest.Path/current pointing to it.
+// With rename switch the releases are kept in Dest.Path.releases/<run-id> and the new one is moved to Dest.Path.
+func NewRelease(dest Dest, id string) Release {
+	if dest.Switch == SwitchRename {
+		releases := dest.Path + ".releases"
+		return Release{Dir: path.Join(releases, id), Live: dest.Path, Releases: releases, Switch: SwitchRename}
+	}
+
+	releases := path.Join(dest.Path, "releases")
+	return Release{Dir: path.Join(releases, id), Live: path.Join(dest.Path, "current"), Releases: releases, Switch: SwitchSymlink}
+}
+
+// Activate will switch the live path to the release
+//
+// Symlink switch creates a temporary link and renames it over the current one, which is atomic. Rename switch moves
+// the live directory into the releases as "<run-id>.previous" and then moves the release in place, so there is a
+// short window between both renames.
+func (r Release) Activate(exec Executor) error {
+	_, err := exec.Run(r.ActivateCommand())
+	return err
+}
+
+// ActivateCommand returns the command switching the live path to the release
+func (r Release) ActivateCommand() string {
+	id := path.Base(r.Dir)
+
+	if r.Switch == SwitchRename {
+		// the previous release is moved back when the new one can't take its place, so that the site stays live
+		live, dir, previous := QuotePath(r.Live), QuotePath(r.Dir), QuotePath(r.Dir+".previous")
+		return fmt.Sprintf("if [ -e %s ]; then mv -T %s %s || exit 1; fi; mv -T %s %s || { [ ! -e %s ] || mv -T %s %s; exit 1; }",
+			live, live, previous, dir, live, previous, previous, live)
+	}
+
+	// link is relative, so the site keeps working when the parent directory is moved
+	tmp := fmt.Sprintf("%s.%s.tmp", r.Live, id)
+	return fmt.Sprintf("ln -sfn %s %s && mv -T %s %s",
+		QuotePath(path.Join(path.Base(r.Releases), id)), QuotePath(tmp), QuotePath(tmp), QuotePath(r.Live))
+}
+
+// Prune will remove the oldest releases, keeping the newest ones. Release names are run ids which sort by time
+// The release being served is never removed. It returns the removed release directories
+func (r Release) Prune(exec Executor, keep int) ([]string, error) {
+	output, err := exec.Run(fmt.Sprintf("ls -1 %s", QuotePath(r.Releases)))
+	if err != nil {
+		return nil, err
+	}
+
+	names := strings.Fields(output)
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	removed := make([]string, 0)
+	for i, name := range names {
+		if i < keep || name == path.Base(r.Dir) {
+			continue
+		}
+
+		dir := path.Join(r.Releases, name)
+		cmd, err := RemoveCommand(dir)
+		if err != nil {
+			return removed, err
+		}
+		if _, err := exec.Run(cmd); err != nil {
+			return removed, err
+		}
+		removed = append(removed, dir)
+	}
+	return removed, nil
+}
+
+// validateRelease will check the atomic restore options and add the defaults
+func (c *Config) validateRelease() {
+	for i := range c.Files {
+		dest := &c.Files[i].Dest
+		if !dest.Atomic {
+			continue
+		}
+
+		if len(dest.Switch) == 0 {
+			dest.Switch = SwitchSymlink
+		}
+
+		if dest.Switch != SwitchSymlink && dest.Switch != SwitchRename {
+			Log.Fatalf("Switch %s in files[%d] is not supported, use symlink or rename", dest.Switch, i)
+		}
+
+		if dest.KeepReleases < 0 {
+			Log.Fatalf("Keep releases in files[%d] can't be negative", i)
+		} else if dest.KeepReleases == 0 {
+			dest.KeepReleases = 5
+			Log.Tracef("Defaulting keep-releases '5' for files[%d]", i)
+		}
+
+		// every release is extracted into a fresh directory, so there is nothing to conflict with
+		if dest.Conflict != ConflictOverwrite {
+			Log.Fatalf("Conflict policy %s in files[%d] can't be used with atomic restore", dest.Conflict, i)
+		}
+	}
+}
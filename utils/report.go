@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// FileReport is the outcome of the transfer of a single file
+type FileReport struct {
+	// Src is the source of the file in user@host:path form
+	Src string
+	// Dest is the destination of the file in user@host:path form
+	Dest string
+	// Success tells whether the file has been restored
+	Success bool
+	// Reason is the error which stopped the transfer
+	Reason string
+	// Warnings are the non fatal problems found during the transfer
+	Warnings []string
+	// Conflicts are the destination paths which already existed, with the action taken on them
+	Conflicts []string
+	// Differences are the restored files which don't match the source manifest
+	Differences []string
+}
+
+// NewFileReport will create the report of the file with its source and destination
+func NewFileReport(file File, conf Config) *FileReport {
+	src, dest := GetAdaptorFromName(file.Src.Adaptor, conf), GetAdaptorFromName(file.Dest.Adaptor, conf)
+	return &FileReport{
+		Src:  fmt.Sprintf("%s@%s:%s", src.User, src.Host, file.Src.Path),
+		Dest: fmt.Sprintf("%s@%s:%s", dest.User, dest.Host, file.Dest.Path),
+	}
+}
+
+// Warn will log the warning and keep it in the report
+func (f *FileReport) Warn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	Log.Warn(msg)
+	f.Warnings = append(f.Warnings, msg)
+}
+
+// Fail will log the reason of skipping the file and keep it in the report
+func (f *FileReport) Fail(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	Log.Warn(msg)
+	f.Success = false
+	f.Reason = msg
+}
+
+// Report collects the outcome of every file in the run
+type Report struct {
+	sync.Mutex
+	// Files are the reports of the files in the order of completion
+	Files []*FileReport
+}
+
+// Add will append the file report, it is safe to call from the transfer goroutines
+func (r *Report) Add(file *FileReport) {
+	r.Lock()
+	defer r.Unlock()
+	r.Files = append(r.Files, file)
+}
+
+// Print will write the human readable summary of the run
+func (r *Report) Print(w io.Writer) {
+	r.Lock()
+	defer r.Unlock()
+
+	failed := 0
+	fmt.Fprintln(w, "Run report:")
+	for _, file := range r.Files {
+		status := "OK"
+		if !file.Success {
+			status = "FAILED"
+			failed++
+		}
+
+		fmt.Fprintf(w, "  [%s] %s -> %s\n", status, file.Src, file.Dest)
+		if len(file.Reason) > 0 {
+			fmt.Fprintf(w, "      reason: %s\n", file.Reason)
+		}
+		for _, warning := range file.Warnings {
+			fmt.Fprintf(w, "      warning: %s\n", warning)
+		}
+		for _, conflict := range file.Conflicts {
+			fmt.Fprintf(w, "      conflict: %s\n", conflict)
+		}
+		for _, difference := range file.Differences {
+			fmt.Fprintf(w, "      verify: %s\n", difference)
+		}
+	}
+	fmt.Fprintf(w, "%d restored, %d failed\n", len(r.Files)-failed, failed)
+}
+
+// Run holds the state shared by all the transfers of a single syncbit invocation
+type Run struct {
+	sync.Mutex `json:"-"`
+	// ID is the unique identifier of the run
+	ID string `json:"id"`
+	// Report collects the outcome of the files
+	Report *Report `json:"-"`
+	// Snapshots are the destinations stored before restoring, saved to disk for the rollback
+	Snapshots []Snapshot `json:"snapshots"`
+	// Bandwidth holds the rate limiters shared by the transfers
+	Bandwidth *Bandwidth `json:"-"`
+}
+
+// NewRun will create the run with a new unique identifier
+func NewRun() *Run {
+	return &Run{ID: GetRunID(), Report: &Report{}}
+}
@@ -0,0 +1,346 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Streams is the concurrency of the transfer of a single archive
+type Streams struct {
+	// Count is the number of SFTP sessions, each one transfers a range at a time
+	Count int
+	// ChunkSize is the size of the ranges
+	ChunkSize int64
+	// Limiters throttle every stream, nil limiters are unlimited
+	Limiters []*Limiter
+}
+
+// AdaptorStreams returns the streams configured on the adaptor, throttled by the limiters
+func AdaptorStreams(adaptor *Adaptor, limiters []*Limiter) Streams {
+	return Streams{Count: adaptor.Streams, ChunkSize: int64(adaptor.ChunkSize), Limiters: limiters}
+}
+
+// ResumableDownload will download the remote file, continuing from the partial local file when it is a prefix
+// of the remote one. The ranges after the partial file are downloaded concurrently over the streams, and on failure
+// the local file is cut to the completed prefix, so that the next run picks it up
+func ResumableDownload(exec Executor, remote string, local string, streams Streams) error {
+	ftp, err := exec.Client.NewSftp()
+	if err != nil {
+		return err
+	}
+	defer ftp.Close()
+
+	stat, err := ftp.Stat(remote)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	if partial, err := os.Stat(local); err == nil {
+		offset = resumeOffset(exec, remote, local, partial.Size(), stat.Size())
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	dst, err := os.OpenFile(local, flags, 0600)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	// every stream reads from its own session, the local file is shared
+	open := func() (io.ReaderAt, io.WriterAt, func(), error) {
+		session, err := exec.Client.NewSftp()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		src, err := session.Open(remote)
+		if err != nil {
+			session.Close()
+			return nil, nil, nil, err
+		}
+		return src, dst, func() { src.Close(); session.Close() }, nil
+	}
+
+	completed, err := transferRanges(offset, stat.Size(), streams, open)
+	if err != nil {
+		dst.Truncate(completed)
+		return err
+	}
+	return dst.Truncate(stat.Size())
+}
+
+// ResumableUpload will upload the local file, continuing from the partial remote file when it is a prefix
+// of the local one. The ranges after the partial file are uploaded concurrently over the streams, and on failure
+// the remote file is cut to the completed prefix, so that the next run picks it up
+func ResumableUpload(exec Executor, local string, remote string, streams Streams) error {
+	ftp, err := exec.Client.NewSftp()
+	if err != nil {
+		return err
+	}
+	defer ftp.Close()
+
+	src, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	if partial, err := ftp.Stat(remote); err == nil {
+		offset = resumeOffset(exec, remote, local, partial.Size(), stat.Size())
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	dst, err := ftp.OpenFile(remote, flags)
+	if err != nil {
+		return err
+	}
+	dst.Close()
+
+	// every stream writes with its own session, the local file is shared
+	open := func() (io.ReaderAt, io.WriterAt, func(), error) {
+		session, err := exec.Client.NewSftp()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		dst, err := session.OpenFile(remote, os.O_WRONLY)
+		if err != nil {
+			session.Close()
+			return nil, nil, nil, err
+		}
+		return src, dst, func() { dst.Close(); session.Close() }, nil
+	}
+
+	completed, err := transferRanges(offset, stat.Size(), streams, open)
+	if err != nil {
+		ftp.Truncate(remote, completed)
+		return err
+	}
+	return ftp.Truncate(remote, stat.Size())
+}
+
+// transferRanges will copy the bytes from offset to total in ranges of the chunk size, every stream opens its own
+// reader and writer and copies one range at a time. It returns the end of the contiguous copied prefix
+func transferRanges(offset int64, total int64, streams Streams, open func() (io.ReaderAt, io.WriterAt, func(), error)) (int64, error) {
+	if streams.Count <= 0 {
+		streams.Count = 1
+	}
+	if streams.ChunkSize <= 0 {
+		streams.ChunkSize = total - offset
+	}
+
+	var starts []int64
+	for start := offset; start < total; start += streams.ChunkSize {
+		starts = append(starts, start)
+	}
+	if len(starts) == 0 {
+		return total, nil
+	}
+	if streams.Count > len(starts) {
+		streams.Count = len(starts)
+	}
+
+	ranges := make(chan int, len(starts))
+	for i := range starts {
+		ranges <- i
+	}
+	close(ranges)
+
+	var mutex sync.Mutex
+	var firstErr error
+	done := make([]bool, len(starts))
+
+	var wg sync.WaitGroup
+	for i := 0; i < streams.Count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			reader, writer, closer, err := open()
+			if err != nil {
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mutex.Unlock()
+				return
+			}
+			defer closer()
+
+			for index := range ranges {
+				mutex.Lock()
+				failed := firstErr != nil
+				mutex.Unlock()
+				if failed {
+					return
+				}
+
+				end := starts[index] + streams.ChunkSize
+				if end > total {
+					end = total
+				}
+
+				err := copyRange(reader, writer, starts[index], end, streams.Limiters)
+				mutex.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				done[index] = err == nil
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr == nil {
+		return total, nil
+	}
+
+	// ranges complete out of order, only the prefix before the first missing one can be resumed
+	for i := range starts {
+		if !done[i] {
+			return starts[i], firstErr
+		}
+	}
+	return total, firstErr
+}
+
+// copyRange will copy the bytes between start and end at the same position of the writer, within the limiters rate
+func copyRange(reader io.ReaderAt, writer io.WriterAt, start int64, end int64, limiters []*Limiter) error {
+	buffer := make([]byte, 1<<20)
+	for position := start; position < end; {
+		size := int64(len(buffer))
+		if end-position < size {
+			size = end - position
+		}
+
+		n, err := reader.ReadAt(buffer[:size], position)
+		for _, limiter := range limiters {
+			limiter.Wait(n)
+		}
+		if n > 0 {
+			if _, err := writer.WriteAt(buffer[:n], position); err != nil {
+				return err
+			}
+			position += int64(n)
+		}
+
+		if err == io.EOF && position < end {
+			return io.ErrUnexpectedEOF
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+// resumeOffset returns the size of the partial copy when its contents match the same prefix of the original,
+// otherwise the transfer has to start over and 0 is returned
+func resumeOffset(exec Executor, remote string, local string, partial int64, total int64) int64 {
+	if partial == 0 || partial > total {
+		return 0
+	}
+
+	localSum, err := LocalPrefixChecksum(local, partial)
+	if err != nil {
+		Log.Tracef("Not resuming %s, error while hashing local prefix: %s", remote, err.Error())
+		return 0
+	}
+
+	remoteSum, err := RemotePrefixChecksum(exec, remote, partial)
+	if err != nil {
+		Log.Tracef("Not resuming %s, error while hashing remote prefix: %s", remote, err.Error())
+		return 0
+	}
+
+	if localSum != remoteSum {
+		Log.Tracef("Not resuming %s, partial copy doesn't match the first %d bytes", remote, partial)
+		return 0
+	}
+
+	Log.Infof("Resuming transfer of %s from %d of %d bytes", remote, partial, total)
+	return partial
+}
+
+// ChecksumsFile returns the path of the file keeping the checksums of the archive, or of its list and volumes when
+// it is split. It is only written when a download or upload of the archive breaks, so it marks the archive kept for
+// resuming the transfer in the next run
+func ChecksumsFile(archive string) string {
+	return archive + ".sha256"
+}
+
+// SaveChecksums will write the checksums of the parts of the archive to its checksums file on the adaptor, in the
+// format of "sha256sum -c"
+func SaveChecksums(exec Executor, archive string, parts []Part) error {
+	name := path.Base(archive)
+	var lines strings.Builder
+	for _, part := range parts {
+		lines.WriteString(part.Checksum + "  " + name + part.Suffix + "\n")
+	}
+
+	_, err := exec.Run(fmt.Sprintf("printf '%%s' %s > %s", Quote(lines.String()), QuotePath(ChecksumsFile(archive))))
+	return err
+}
+
+// RemoveArchiveCommand returns the command removing the archive along with its list, volumes, extraction markers
+// and checksums file, after checking the archive path with CheckDestructivePath
+func RemoveArchiveCommand(archive string) (string, error) {
+	if err := CheckDestructivePath(archive); err != nil {
+		return "", err
+	}
+
+	// globs are kept out of the quotes
+	quoted := QuotePath(archive)
+	return fmt.Sprintf("rm -f -- %s %s.list %s.part-* %s.done %s", quoted, quoted, quoted, quoted, QuotePath(ChecksumsFile(archive))), nil
+}
+
+// KeptArchiveCommand returns the command checking the archive kept by the previous run against its checksums file
+// and printing the checksums, it fails when the checksums file is missing or any part doesn't match
+func KeptArchiveCommand(archive string) string {
+	dir, checksums := path.Split(ChecksumsFile(archive))
+	return InDir(dir, BuildCommand("sha256sum", "-c", "--quiet", "--", checksums)+" >/dev/null && "+BuildCommand("cat", "--", checksums))
+}
+
+// KeptArchive returns the parts of the archive kept by the broken transfer of the previous run, when they all still
+// match their checksums. Archiving again gives different bytes, because of the changed files and the timestamps in
+// the archive, so the kept archive is the only one the partial copies can be resumed from
+func KeptArchive(exec Executor, archive string) ([]Part, bool) {
+	if _, err := exec.Run(BuildCommand("test", "-e", ChecksumsFile(archive))); err != nil {
+		return nil, false
+	}
+
+	output, err := exec.Run(KeptArchiveCommand(archive))
+	if err != nil {
+		Log.Infof("Not reusing %s, it doesn't match its checksums: %s", archive, err.Error())
+		return nil, false
+	}
+
+	name := path.Base(archive)
+	parts := make([]Part, 0)
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.SplitN(line, "  ", 2)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], name) {
+			Log.Infof("Not reusing %s, malformed checksum line %q", archive, line)
+			return nil, false
+		}
+		parts = append(parts, Part{Suffix: strings.TrimPrefix(fields[1], name), Checksum: fields[0]})
+	}
+	return parts, len(parts) > 0
+}
@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// memoryFile is the in memory destination of the ranges
+type memoryFile struct {
+	sync.Mutex
+	data []byte
+}
+
+func (m *memoryFile) WriteAt(b []byte, offset int64) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	copy(m.data[offset:], b)
+	return len(b), nil
+}
+
+// brokenReader fails every read reaching the position, like a dropped connection
+type brokenReader struct {
+	io.ReaderAt
+	position int64
+}
+
+func (b brokenReader) ReadAt(p []byte, offset int64) (int, error) {
+	if offset+int64(len(p)) > b.position {
+		return 0, fmt.Errorf("connection lost")
+	}
+	return b.ReaderAt.ReadAt(p, offset)
+}
+
+func TestTransferRanges(t *testing.T) {
+	tests := []struct {
+		name      string
+		offset    int64
+		total     int64
+		streams   Streams
+		broken    int64
+		openErr   bool
+		want      int64
+		wantOpens int
+		wantErr   bool
+	}{
+		{"whole file", 0, 95, Streams{Count: 4, ChunkSize: 10}, -1, false, 95, 4, false},
+		{"single range without chunk size", 0, 95, Streams{Count: 4}, -1, false, 95, 1, false},
+		{"resume from offset", 40, 95, Streams{Count: 2, ChunkSize: 10}, -1, false, 95, 2, false},
+		{"offset equals total", 95, 95, Streams{Count: 4, ChunkSize: 10}, -1, false, 95, 0, false},
+		{"total smaller than streams", 0, 3, Streams{Count: 8, ChunkSize: 1}, -1, false, 3, 3, false},
+		{"broken transfer keeps prefix", 0, 95, Streams{Count: 1, ChunkSize: 10}, 55, false, 50, 1, true},
+		{"broken resumed transfer keeps prefix", 30, 95, Streams{Count: 1, ChunkSize: 10}, 72, false, 70, 1, true},
+		{"open failure keeps offset", 30, 95, Streams{Count: 2, ChunkSize: 10}, -1, true, 30, 2, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := make([]byte, test.total)
+			for i := range src {
+				src[i] = byte(i)
+			}
+			dst := &memoryFile{data: make([]byte, test.total)}
+
+			var mutex sync.Mutex
+			opens := 0
+			open := func() (io.ReaderAt, io.WriterAt, func(), error) {
+				mutex.Lock()
+				opens++
+				mutex.Unlock()
+				if test.openErr {
+					return nil, nil, nil, fmt.Errorf("no session")
+				}
+
+				var reader io.ReaderAt = bytes.NewReader(src)
+				if test.broken >= 0 {
+					reader = brokenReader{reader, test.broken}
+				}
+				return reader, dst, func() {}, nil
+			}
+
+			got, err := transferRanges(test.offset, test.total, test.streams, open)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("transferRanges() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("transferRanges() = %d, want %d", got, test.want)
+			}
+			if opens != test.wantOpens {
+				t.Errorf("opened %d streams, want %d", opens, test.wantOpens)
+			}
+
+			// bytes before the offset belong to the partial copy and are never written again
+			if !bytes.Equal(dst.data[test.offset:got], src[test.offset:got]) {
+				t.Errorf("copied bytes differ from the source")
+			}
+			if test.offset > 0 && !bytes.Equal(dst.data[:test.offset], make([]byte, test.offset)) {
+				t.Errorf("bytes before offset %d were written", test.offset)
+			}
+		})
+	}
+}
+
+func TestResumeOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncbit-resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local := path.Join(dir, "syncbit-1.zip")
+	if err := ioutil.WriteFile(local, []byte("0123456789"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := func(data string) string {
+		hash := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(hash[:]) + "  -\n"
+	}
+
+	tests := []struct {
+		name     string
+		remote   string
+		partial  int64
+		total    int64
+		outputs  map[string]string
+		want     int64
+		commands int
+	}{
+		{"no partial copy", "/tmp/syncbit-1.zip", 0, 10, nil, 0, 0},
+		{"partial larger than total", "/tmp/syncbit-1.zip", 12, 10, nil, 0, 0},
+		{"matching prefix", "/tmp/syncbit-1.zip", 4, 10,
+			map[string]string{"head -c 4 -- /tmp/syncbit-1.zip | sha256sum": sum("0123")}, 4, 1},
+		{"offset equals total", "/tmp/syncbit-1.zip", 10, 10,
+			map[string]string{"head -c 10 -- /tmp/syncbit-1.zip | sha256sum": sum("0123456789")}, 10, 1},
+		// the transfer truncates the partial copy and starts over
+		{"mismatched prefix", "/tmp/syncbit-1.zip", 4, 10,
+			map[string]string{"head -c 4 -- /tmp/syncbit-1.zip | sha256sum": sum("abcd")}, 0, 1},
+		{"empty remote checksum", "/tmp/syncbit-1.zip", 4, 10,
+			map[string]string{"head -c 4 -- /tmp/syncbit-1.zip | sha256sum": ""}, 0, 1},
+		{"remote checksum failure", "/tmp/failed.zip", 4, 10, nil, 0, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := &fakeRunner{outputs: test.outputs}
+			if got := resumeOffset(Executor{Runner: runner}, test.remote, local, test.partial, test.total); got != test.want {
+				t.Errorf("resumeOffset() = %d, want %d", got, test.want)
+			}
+			if len(runner.commands) != test.commands {
+				t.Errorf("commands = %q, want %d commands", runner.commands, test.commands)
+			}
+		})
+	}
+}
+
+func TestKeptArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive string
+		output  string
+		want    []Part
+		wantOK  bool
+	}{
+		{"whole archive", "/tmp/syncbit-1.zip", "aaa  syncbit-1.zip\n", []Part{{Suffix: "", Checksum: "aaa"}}, true},
+		{"split archive", "/tmp/syncbit-1.tar.gz", "aaa  syncbit-1.tar.gz.list\nbbb  syncbit-1.tar.gz.part-000\nccc  syncbit-1.tar.gz.part-001\n",
+			[]Part{{Suffix: ".list", Checksum: "aaa"}, {Suffix: ".part-000", Checksum: "bbb"}, {Suffix: ".part-001", Checksum: "ccc"}}, true},
+		{"name with spaces", "/srv/my staging/syncbit 1.zip", "aaa  syncbit 1.zip\n", []Part{{Suffix: "", Checksum: "aaa"}}, true},
+		{"single space separator", "/tmp/syncbit-1.zip", "aaa syncbit-1.zip\n", nil, false},
+		{"checksum only", "/tmp/syncbit-1.zip", "aaa\n", nil, false},
+		{"other archive", "/tmp/syncbit-1.zip", "aaa  syncbit-2.zip\n", nil, false},
+		{"one malformed line", "/tmp/syncbit-1.tar.gz", "aaa  syncbit-1.tar.gz.list\nbbb\n", nil, false},
+		{"empty checksums file", "/tmp/syncbit-1.zip", "", nil, false},
+		{"missing checksums file", "/tmp/failed.zip", "", nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runner := &fakeRunner{outputs: map[string]string{KeptArchiveCommand(test.archive): test.output}}
+
+			got, ok := KeptArchive(Executor{Runner: runner}, test.archive)
+			if ok != test.wantOK {
+				t.Fatalf("KeptArchive() ok = %v, want %v", ok, test.wantOK)
+			}
+			if ok && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("KeptArchive() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
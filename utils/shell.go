@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// safeWord matches the arguments which don't need any quoting
+var safeWord = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// Quote will wrap the argument in single quotes, so that the remote shell treats it as a single word
+// Arguments made of only safe characters like flags and plain paths are returned as is
+func Quote(arg string) string {
+	if safeWord.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'"'"'`) + "'"
+}
+
+// QuotePath will quote the path like Quote, but keeps the leading "~/" outside the quotes for home expansion
+func QuotePath(p string) string {
+	if p == "~" {
+		return p
+	}
+	if strings.HasPrefix(p, "~/") {
+		return "~/" + Quote(p[2:])
+	}
+	return Quote(p)
+}
+
+// BuildCommand will build the shell command from the program and its arguments, every argument is quoted with QuotePath
+func BuildCommand(program string, args ...string) string {
+	cmd := []string{program}
+	for _, arg := range args {
+		cmd = append(cmd, QuotePath(arg))
+	}
+	return strings.Join(cmd, " ")
+}
+
+// InDir will build the shell command which changes the directory to dir and then runs cmd
+func InDir(dir string, cmd string) string {
+	if len(dir) == 0 {
+		return cmd
+	}
+	return fmt.Sprintf("cd %s && %s", QuotePath(dir), cmd)
+}
+
+// CheckDestructivePath will return error when the path is not safe for destructive operations like rm -rf
+// Empty paths, "/", home directory, the top level directories like "/etc" and paths escaping with ".." are rejected
+func CheckDestructivePath(p string) error {
+	if len(strings.TrimSpace(p)) == 0 {
+		return fmt.Errorf("empty path can't be removed")
+	}
+
+	if strings.ContainsAny(p, "\x00\n") {
+		return fmt.Errorf("path %q has control characters", p)
+	}
+
+	clean := path.Clean(p)
+	switch clean {
+	case "/", ".", "..", "~":
+		return fmt.Errorf("refusing to remove %q", p)
+	}
+
+	if strings.HasPrefix(clean, "../") || strings.Contains(clean, "/../") {
+		return fmt.Errorf("path %q escapes its parent directory", p)
+	}
+
+	// absolute paths must be at least two levels deep, so "/tmp" and "/var" are rejected
+	if path.IsAbs(clean) && strings.Count(clean, "/") < 2 {
+		return fmt.Errorf("refusing to remove top level directory %q", p)
+	}
+	return nil
+}
+
+// RemoveCommand will build the "rm -rf" command for the paths after checking them with CheckDestructivePath
+func RemoveCommand(paths ...string) (string, error) {
+	args := []string{"rm", "-rf", "--"}
+	for _, p := range paths {
+		if err := CheckDestructivePath(p); err != nil {
+			return "", err
+		}
+		args = append(args, QuotePath(p))
+	}
+	return strings.Join(args, " "), nil
+}
+
+// exportEnv will build the shell prefix exporting the "key=value" pairs
+func exportEnv(env []string) string {
+	var prefix strings.Builder
+	for _, pair := range env {
+		kv := strings.SplitN(pair, "=", 2)
+		prefix.WriteString("export " + kv[0] + "=" + Quote(kv[1]) + "; ")
+	}
+	return prefix.String()
+}
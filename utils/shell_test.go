@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{"plain", "plain"},
+		{"/var/www/site", "/var/www/site"},
+		{"--exclude=./dump.zip", "--exclude=./dump.zip"},
+		{"", "''"},
+		{"my site", "'my site'"},
+		{"it's", `'it'"'"'s'`},
+		{"$(rm -rf /)", "'$(rm -rf /)'"},
+		{"`id`", "'`id`'"},
+		{"a; rm -rf /", "'a; rm -rf /'"},
+		{"~/site", "'~/site'"},
+		{"line\nbreak", "'line\nbreak'"},
+	}
+
+	for _, test := range tests {
+		if got := Quote(test.arg); got != test.want {
+			t.Errorf("Quote(%q) = %s, want %s", test.arg, got, test.want)
+		}
+	}
+}
+
+func TestQuotePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/var/www/site", "/var/www/site"},
+		{"/srv/my site", "'/srv/my site'"},
+		{"/srv/it's", `'/srv/it'"'"'s'`},
+		{"/srv/$(id)", "'/srv/$(id)'"},
+		{"~", "~"},
+		{"~/site", "~/site"},
+		{"~/my site", "~/'my site'"},
+		{"~/$(id)", "~/'$(id)'"},
+		{"~user/site", "'~user/site'"},
+	}
+
+	for _, test := range tests {
+		if got := QuotePath(test.path); got != test.want {
+			t.Errorf("QuotePath(%q) = %s, want %s", test.path, got, test.want)
+		}
+	}
+}
+
+func TestBuildCommand(t *testing.T) {
+	tests := []struct {
+		program string
+		args    []string
+		want    string
+	}{
+		{"ls", nil, "ls"},
+		{"mkdir", []string{"-p", "/srv/site"}, "mkdir -p /srv/site"},
+		{"mkdir", []string{"-p", "/srv/my site"}, "mkdir -p '/srv/my site'"},
+		{"touch", []string{"~/a b", "$(id)"}, "touch ~/'a b' '$(id)'"},
+		{"rm", []string{"-f", "--", "it's"}, `rm -f -- 'it'"'"'s'`},
+	}
+
+	for _, test := range tests {
+		if got := BuildCommand(test.program, test.args...); got != test.want {
+			t.Errorf("BuildCommand(%q, %q) = %s, want %s", test.program, test.args, got, test.want)
+		}
+	}
+}
+
+func TestInDir(t *testing.T) {
+	tests := []struct {
+		dir  string
+		cmd  string
+		want string
+	}{
+		{"", "ls", "ls"},
+		{"/var/www/site", "ls", "cd /var/www/site && ls"},
+		{"/srv/my site", "ls", "cd '/srv/my site' && ls"},
+		{"~/site", "ls", "cd ~/site && ls"},
+		{"/srv/$(id)", "ls", "cd '/srv/$(id)' && ls"},
+	}
+
+	for _, test := range tests {
+		if got := InDir(test.dir, test.cmd); got != test.want {
+			t.Errorf("InDir(%q, %q) = %s, want %s", test.dir, test.cmd, got, test.want)
+		}
+	}
+}
+
+func TestCheckDestructivePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{"", true},
+		{"  ", true},
+		{"/", true},
+		{"//", true},
+		{".", true},
+		{"~", true},
+		{"~/", true},
+		{"..", true},
+		{"../site", true},
+		{"a/../..", true},
+		{"/srv/../../etc", true},
+		{"/tmp", true},
+		{"/etc", true},
+		{"/etc/", true},
+		{"/tmp/a\nb", true},
+		{"/tmp/a\x00b", true},
+		{"/tmp/syncbit-1234.zip", false},
+		{"/srv/site", false},
+		{"/srv/my site", false},
+		{"~/site", false},
+		{"site/releases", false},
+	}
+
+	for _, test := range tests {
+		if err := CheckDestructivePath(test.path); (err != nil) != test.wantErr {
+			t.Errorf("CheckDestructivePath(%q) error = %v, wantErr %v", test.path, err, test.wantErr)
+		}
+	}
+}
+
+func TestRemoveCommand(t *testing.T) {
+	tests := []struct {
+		paths   []string
+		want    string
+		wantErr bool
+	}{
+		{[]string{"/tmp/syncbit-1234.zip"}, "rm -rf -- /tmp/syncbit-1234.zip", false},
+		{[]string{"/srv/my site", "~/a b"}, "rm -rf -- '/srv/my site' ~/'a b'", false},
+		{[]string{"/srv/$(id)"}, "rm -rf -- '/srv/$(id)'", false},
+		{[]string{""}, "", true},
+		{[]string{"/"}, "", true},
+		{[]string{"~"}, "", true},
+		{[]string{"~/"}, "", true},
+		{[]string{".."}, "", true},
+		{[]string{"a/../.."}, "", true},
+		{[]string{"/tmp"}, "", true},
+		{[]string{"/etc"}, "", true},
+		{[]string{"/tmp/a\nb"}, "", true},
+		{[]string{"/tmp/a\x00b"}, "", true},
+		// a single unsafe path refuses the whole command
+		{[]string{"/srv/site", "/"}, "", true},
+	}
+
+	for _, test := range tests {
+		got, err := RemoveCommand(test.paths...)
+		if (err != nil) != test.wantErr {
+			t.Errorf("RemoveCommand(%q) error = %v, wantErr %v", test.paths, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("RemoveCommand(%q) = %s, want %s", test.paths, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Size is an amount of bytes, in config it is written as a number with optional K, M or G suffix, like "64M"
+type Size int64
+
+// sizeUnits are the multipliers of the suffixes, they are powers of 1024
+var sizeUnits = map[string]int64{"": 1, "B": 1, "K": 1 << 10, "KB": 1 << 10, "M": 1 << 20, "MB": 1 << 20, "G": 1 << 30, "GB": 1 << 30}
+
+// ParseSize will convert the human readable size into bytes
+func ParseSize(text string) (Size, error) {
+	text = strings.ToUpper(strings.TrimSpace(text))
+	number := strings.TrimRight(text, "KMGB")
+
+	unit, ok := sizeUnits[strings.TrimSpace(text[len(number):])]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit in size %q", text)
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("malformed size %q", text)
+	}
+	return Size(value * float64(unit)), nil
+}
+
+// UnmarshalYAML will accept the size as plain number of bytes or with a unit suffix
+func (s *Size) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var text string
+	if err := unmarshal(&text); err != nil {
+		return err
+	}
+
+	size, err := ParseSize(text)
+	if err != nil {
+		return err
+	}
+	*s = size
+	return nil
+}
+
+// String will print the size with the largest unit it is a multiple of
+func (s Size) String() string {
+	for _, unit := range []string{"G", "M", "K"} {
+		if s > 0 && int64(s)%sizeUnits[unit] == 0 {
+			return fmt.Sprintf("%d%s", int64(s)/sizeUnits[unit], unit)
+		}
+	}
+	return fmt.Sprintf("%d", int64(s))
+}
+
+// Human will print the size rounded to one decimal in the largest fitting unit, like "1.5G"
+func (s Size) Human() string {
+	for _, unit := range []string{"G", "M", "K"} {
+		if s >= Size(sizeUnits[unit]) {
+			return fmt.Sprintf("%.1f%s", float64(s)/float64(sizeUnits[unit]), unit)
+		}
+	}
+	return fmt.Sprintf("%dB", int64(s))
+}
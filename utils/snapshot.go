@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// SnapshotArchive stores the destination as a tar.gz file next to it
+	SnapshotArchive = "archive"
+	// SnapshotCopy stores the destination as a copy of the directory next to it
+	SnapshotCopy = "copy"
+)
+
+// Snapshot is the copy of the destination taken before restoring, it is used to roll back
+type Snapshot struct {
+	// Adaptor is the name of the destination adaptor
+	Adaptor string `json:"adaptor"`
+	// Path is the destination directory
+	Path string `json:"path"`
+	// Location is the snapshot archive or directory
+	Location string `json:"location"`
+	// Mode is archive or copy
+	Mode string `json:"mode"`
+	// Existed tells whether the destination existed when the snapshot was taken
+	Existed bool `json:"existed"`
+	// Become tells whether the snapshot was taken through sudo, the password is never saved
+	Become *bool `json:"become,omitempty"`
+	// BecomeUser is the sudo user the snapshot was taken as
+	BecomeUser string `json:"become-user,omitempty"`
+}
+
+// TakeSnapshot will store the destination directory next to it as archive or copy
+func TakeSnapshot(exec Executor, adaptor string, dest Dest, id string) (Snapshot, error) {
+	snapshot := Snapshot{Adaptor: adaptor, Path: dest.Path, Mode: dest.Snapshot, Become: exec.Become.Enabled, BecomeUser: exec.Become.User}
+
+	output, err := exec.Run(fmt.Sprintf("[ -d %s ] && echo yes || echo no", QuotePath(dest.Path)))
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.Existed = strings.TrimSpace(output) == "yes"
+
+	// nothing to store, rollback will remove the destination
+	if !snapshot.Existed {
+		return snapshot, nil
+	}
+
+	var cmd string
+	snapshot.Location, cmd = SnapshotCommand(dest, id)
+	_, err = exec.Run(cmd)
+	return snapshot, err
+}
+
+// SnapshotCommand returns the location of the snapshot of the existing destination and the command storing it there
+func SnapshotCommand(dest Dest, id string) (string, string) {
+	if dest.Snapshot == SnapshotCopy {
+		location := fmt.Sprintf("%s.syncbit-snapshot-%s", dest.Path, id)
+		return location, BuildCommand("cp", "-a", dest.Path, location)
+	}
+
+	location := fmt.Sprintf("%s.syncbit-snapshot-%s.tar.gz", dest.Path, id)
+	return location, InDir(dest.Path, BuildCommand("tar", "-c", "-p", "-z", "-f", location, "."))
+}
+
+// Privilege returns the become settings the snapshot was taken with, the password comes from the file of the config
+// restoring to the same destination, the adaptor password is used otherwise
+func (s Snapshot) Privilege(conf Config) Become {
+	privilege := Become{Enabled: s.Become, User: s.BecomeUser}
+	for _, file := range conf.Files {
+		if file.Dest.Adaptor == s.Adaptor && file.Dest.Path == s.Path {
+			privilege.Password = file.Privilege.Password
+		}
+	}
+	return privilege
+}
+
+// Restore will replace the destination with the snapshot, the snapshot itself is kept
+func (s Snapshot) Restore(exec Executor) error {
+	remove, err := RemoveCommand(s.Path)
+	if err != nil {
+		return err
+	}
+
+	cmd := remove
+	if s.Existed && s.Mode == SnapshotCopy {
+		cmd += " && " + BuildCommand("cp", "-a", s.Location, s.Path)
+	} else if s.Existed {
+		cmd += " && " + BuildCommand("mkdir", "-p", s.Path) + " && " + InDir(s.Path, BuildCommand("tar", "-x", "-p", "-z", "-f", s.Location))
+	}
+
+	_, err = exec.Run(cmd)
+	return err
+}
+
+// AddSnapshot will record the snapshot in the run and save the run state, so that it can be rolled back later
+func (r *Run) AddSnapshot(snapshot Snapshot) error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.Snapshots = append(r.Snapshots, snapshot)
+	return r.save()
+}
+
+// save will write the run state as json in the runs directory
+func (r *Run) save() error {
+	dir, err := RunsDir()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	raw, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, r.ID+".json"), raw, 0600)
+}
+
+// LoadRun will read the saved state of the run
+func LoadRun(id string) (*Run, error) {
+	dir, err := RunsDir()
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := ioutil.ReadFile(path.Join(dir, path.Base(id)+".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	run := &Run{Report: &Report{}}
+	if err := json.Unmarshal(raw, run); err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// RunsDir returns the directory where the state of every run is saved
+func RunsDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(home, ".syncbit", "runs"), nil
+}
+
+// validateSnapshot will check the snapshot options of the destinations
+func (c *Config) validateSnapshot() {
+	for i, file := range c.Files {
+		switch file.Dest.Snapshot {
+		case "", SnapshotArchive, SnapshotCopy:
+		default:
+			Log.Fatalf("Snapshot %s in files[%d] is not supported, use archive or copy", file.Dest.Snapshot, i)
+		}
+
+		// failed releases are never switched live, so there is nothing to roll back
+		if len(file.Dest.Snapshot) > 0 && file.Dest.Atomic {
+			Log.Fatalf("Snapshot in files[%d] can't be used with atomic restore", i)
+		}
+	}
+}
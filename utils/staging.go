@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// NewFileExecutor will create the executor of the source or destination adaptor of the file, the staging directory
+// of the side overrides the adaptor one
+func NewFileExecutor(conn SSHConnections, file File, source bool, conf Config) Executor {
+	name := file.Dest.Adaptor
+	if source {
+		name = file.Src.Adaptor
+	}
+
+	executor := NewExecutor(conn, name, file, conf)
+	executor.Staging = file.RemoteStaging(source, conf)
+	return executor
+}
+
+// RemoteStaging returns the staging directory on the source or destination adaptor of the file
+func (f File) RemoteStaging(source bool, conf Config) string {
+	name, staging := f.Dest.Adaptor, f.Dest.StagingDir
+	if source {
+		name, staging = f.Src.Adaptor, f.Src.StagingDir
+	}
+
+	if len(staging) == 0 {
+		if adaptor := GetAdaptorFromName(name, conf); adaptor != nil {
+			staging = adaptor.StagingDir
+		}
+	}
+	return staging
+}
+
+// StagingPaths are the locations of the archive on every hop of the transfer
+type StagingPaths struct {
+	// Name is the staging file name, it is the same in every run so that partial transfers can be resumed
+	Name string
+	// Src is the archive in the staging directory of the source, named apart from the destination one in case both
+	// are the same directory
+	Src string
+	// Local is the downloaded archive in the local staging directory
+	Local string
+	// Dest is the uploaded archive in the staging directory of the destination
+	Dest string
+}
+
+// NewStagingPaths will build the archive locations of the file
+func NewStagingPaths(file File, conf Config, archiver Archiver) StagingPaths {
+	base := GetResumableStagingName(file)
+	name := base + archiver.Extension()
+	return StagingPaths{
+		Name:  name,
+		Src:   path.Join(file.RemoteStaging(true, conf), base+".src"+archiver.Extension()),
+		Local: path.Join(file.LocalStaging(conf), name),
+		Dest:  path.Join(file.RemoteStaging(false, conf), name),
+	}
+}
+
+// LocalStaging returns the local directory for the temporary files of the file, file setting overrides the global one
+func (f File) LocalStaging(conf Config) string {
+	if len(f.StagingDir) > 0 {
+		return f.StagingDir
+	}
+	return conf.Settings.StagingDir
+}
+
+// CheckStaging will test that the staging directory exists and is writable on the adaptor
+func CheckStaging(exec Executor, dir string) error {
+	output, err := exec.Run(fmt.Sprintf("[ -d %s ] && [ -w %s ] && echo yes || echo no", QuotePath(dir), QuotePath(dir)))
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(output) != "yes" {
+		return fmt.Errorf("%s is not a writable directory", dir)
+	}
+	return nil
+}
+
+// CheckLocalStaging will test that the local staging directory exists and is writable
+func CheckLocalStaging(dir string) error {
+	f, err := ioutil.TempFile(dir, ".syncbit-check-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// validateStaging will check the staging directories and add the defaults
+func (c *Config) validateStaging() {
+	if len(c.Settings.StagingDir) == 0 {
+		c.Settings.StagingDir = os.TempDir()
+		Log.Tracef("Defaulting staging-dir '%s' for local", c.Settings.StagingDir)
+	}
+
+	// sftp doesn't expand ~ and $HOME, so remote directories have to be absolute
+	for i := range c.Adaptors {
+		adaptor := &c.Adaptors[i]
+		if len(adaptor.StagingDir) == 0 {
+			adaptor.StagingDir = "/tmp"
+			Log.Tracef("Defaulting staging-dir '/tmp' for %s adaptor", adaptor.Name)
+		}
+
+		if !path.IsAbs(adaptor.StagingDir) {
+			Log.Fatalf("Staging directory %s of %s adaptor is not absolute", adaptor.StagingDir, adaptor.Name)
+		}
+	}
+
+	for i, file := range c.Files {
+		for _, dir := range []string{file.Src.StagingDir, file.Dest.StagingDir} {
+			if len(dir) > 0 && !path.IsAbs(dir) {
+				Log.Fatalf("Staging directory %s in files[%d] is not absolute", dir, i)
+			}
+		}
+	}
+}
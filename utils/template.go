@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// Endpoint is the resolved view of source or destination exposed to the templates
+type Endpoint struct {
+	// Path is the directory on the adaptor
+	Path string
+	// Adaptor is the name of the connection adaptor
+	Adaptor string
+	// User is the SSH user of the adaptor
+	User string
+	// Host is the ip or hostname of the adaptor
+	Host string
+	// Port is the SSH port of the adaptor
+	Port int
+}
+
+// AdaptorView is the view of the adaptor executing the command exposed to the templates, the credentials are left out
+type AdaptorView struct {
+	// Name of the adaptor
+	Name string
+	// User is the SSH user of the adaptor
+	User string
+	// Host is the ip or hostname of the adaptor
+	Host string
+	// Port is the SSH port of the adaptor
+	Port int
+}
+
+// TemplateData holds the variables available in hook commands and paths
+//
+// Available variables are: .Src.Path, .Src.Adaptor, .Src.User, .Src.Host, .Src.Port, the same set on .Dest,
+// .Adaptor.Name, .Adaptor.User, .Adaptor.Host, .Adaptor.Port of the adaptor on which the command is executed,
+// .RunID, .StagingFile, .Env.NAME for environment variables and .Vars.NAME for the outputs registered by the previous
+// hooks of the same file
+type TemplateData struct {
+	// Src is the source endpoint of the file
+	Src Endpoint
+	// Dest is the destination endpoint of the file
+	Dest Endpoint
+	// Adaptor is the adaptor on which the command is going to be executed
+	Adaptor AdaptorView
+	// RunID is the unique identifier of the current syncbit run
+	RunID string
+	// StagingFile is the name of the staged archive for the file
+	StagingFile string
+	// Env holds the environment variables of the syncbit process
+	Env map[string]string
+	// Vars holds the outputs registered by the hooks of the file
+	Vars map[string]string
+}
+
+// NewTemplateData will build the template variables for the file
+func NewTemplateData(file File, conf Config, runID string, stagingFile string) TemplateData {
+	data := TemplateData{
+		Src:         newEndpoint(file.Src.Path, file.Src.Adaptor, conf),
+		Dest:        newEndpoint(file.Dest.Path, file.Dest.Adaptor, conf),
+		RunID:       runID,
+		StagingFile: stagingFile,
+		Env:         make(map[string]string),
+		Vars:        make(map[string]string),
+	}
+
+	for _, pair := range os.Environ() {
+		if kv := strings.SplitN(pair, "=", 2); len(kv) == 2 {
+			data.Env[kv[0]] = kv[1]
+		}
+	}
+
+	return data
+}
+
+// On returns the copy of template data with .Adaptor set to the named adaptor
+func (t TemplateData) On(name string, conf Config) TemplateData {
+	if adaptor := GetAdaptorFromName(name, conf); adaptor != nil {
+		t.Adaptor = AdaptorView{Name: adaptor.Name, User: adaptor.User, Host: adaptor.Host, Port: adaptor.Port}
+	}
+	return t
+}
+
+// ExpandPath will expand the template in source or destination path of the file and update the data with it
+func (t *TemplateData) ExpandPath(file *File, source bool, conf Config) error {
+	target, adaptor := &file.Dest.Path, file.Dest.Adaptor
+	if source {
+		target, adaptor = &file.Src.Path, file.Src.Adaptor
+	}
+
+	expanded, err := RenderTemplate(*target, t.On(adaptor, conf))
+	if err != nil {
+		return err
+	}
+
+	*target = expanded
+	if source {
+		t.Src.Path = expanded
+	} else {
+		t.Dest.Path = expanded
+	}
+	return nil
+}
+
+// Environ returns the template variables as SYNCBIT_* environment variables in "key=value" form
+func (t TemplateData) Environ() []string {
+	env := []string{
+		"SYNCBIT_RUN_ID=" + t.RunID,
+		"SYNCBIT_STAGING_FILE=" + t.StagingFile,
+		"SYNCBIT_SRC_PATH=" + t.Src.Path,
+		"SYNCBIT_SRC_ADAPTOR=" + t.Src.Adaptor,
+		"SYNCBIT_SRC_USER=" + t.Src.User,
+		"SYNCBIT_SRC_HOST=" + t.Src.Host,
+		"SYNCBIT_DEST_PATH=" + t.Dest.Path,
+		"SYNCBIT_DEST_ADAPTOR=" + t.Dest.Adaptor,
+		"SYNCBIT_DEST_USER=" + t.Dest.User,
+		"SYNCBIT_DEST_HOST=" + t.Dest.Host,
+		"SYNCBIT_ADAPTOR=" + t.Adaptor.Name,
+	}
+
+	// registered vars are exposed as SYNCBIT_VAR_<NAME>
+	for name, value := range t.Vars {
+		key := strings.Map(func(r rune) rune {
+			if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+				return r
+			}
+			return '_'
+		}, strings.ToUpper(name))
+		env = append(env, fmt.Sprintf("SYNCBIT_VAR_%s=%s", key, value))
+	}
+	return env
+}
+
+// newEndpoint will resolve the adaptor details for the endpoint
+func newEndpoint(path string, name string, conf Config) Endpoint {
+	endpoint := Endpoint{Path: path, Adaptor: name}
+	if adaptor := GetAdaptorFromName(name, conf); adaptor != nil {
+		endpoint.User = adaptor.User
+		endpoint.Host = adaptor.Host
+		endpoint.Port = adaptor.Port
+	}
+	return endpoint
+}
+
+// RenderTemplate will expand the go template in text with the given data
+func RenderTemplate(text string, data TemplateData) (string, error) {
+	// skip the parsing when there is nothing to expand
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	tmpl, err := template.New("syncbit").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var output bytes.Buffer
+	if err := tmpl.Execute(&output, data); err != nil {
+		return "", err
+	}
+	return output.String(), nil
+}
+
+// validateTemplates will parse and execute all the templates in config with sample data
+func (c *Config) validateTemplates() {
+	check := func(where string, text string, data TemplateData) {
+		if _, err := RenderTemplate(text, data); err != nil {
+			Log.Fatalf("Invalid template in %s: %s", where, err.Error())
+		}
+	}
+
+	for i, file := range c.Files {
+		data := NewTemplateData(file, *c, "validate", "validate")
+		data.Vars = c.registeredVars(file)
+		src, dest := data.On(file.Src.Adaptor, *c), data.On(file.Dest.Adaptor, *c)
+
+		check(fmt.Sprintf("files[%d].src.path", i), file.Src.Path, src)
+		check(fmt.Sprintf("files[%d].dest.path", i), file.Dest.Path, dest)
+
+		for _, stage := range Stages {
+			side := dest
+			if stage.IsSource() {
+				side = src
+			}
+
+			hooks := append(append([]Hook{}, c.Global.Hooks.Get(stage)...), file.Hooks(stage)...)
+			for _, hook := range hooks {
+				for _, text := range hook.templates() {
+					check(fmt.Sprintf("files[%d] %s hooks", i, stage), text, side)
+				}
+			}
+		}
+	}
+}
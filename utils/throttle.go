@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket limiting the bytes per second, it is shared by the concurrent transfers
+// Every caller reserves its bytes in turn and sleeps off the debt, so the bandwidth is split fairly among them
+type Limiter struct {
+	sync.Mutex
+	// rate is the number of bytes added to the bucket every second
+	rate float64
+	// burst is the capacity of the bucket, it is also the largest piece reserved at once
+	burst int
+	// tokens are the bytes available, negative when reserved ahead
+	tokens float64
+	// last is the time when tokens have been updated
+	last time.Time
+}
+
+// NewLimiter will create the limiter of the rate, nil limiter is returned for unlimited rate
+func NewLimiter(rate Size) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	// a tenth of the rate keeps the pieces small enough to interleave the transfers
+	burst := int(rate / 10)
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{rate: float64(rate), burst: burst, tokens: float64(burst), last: time.Now()}
+}
+
+// Wait will block until n bytes can be transferred within the rate, nil limiter never blocks
+func (l *Limiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+
+	for n > 0 {
+		piece := n
+		if piece > l.burst {
+			piece = l.burst
+		}
+		n -= piece
+
+		l.Lock()
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > float64(l.burst) {
+			l.tokens = float64(l.burst)
+		}
+		l.last = now
+		l.tokens -= float64(piece)
+		delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+		l.Unlock()
+
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+}
+
+// Bandwidth holds the limiters of the run, one for all the transfers and one for each adaptor
+type Bandwidth struct {
+	// Global limits all the downloads and uploads together
+	Global *Limiter
+	// Adaptors limit the transfers from or to the adaptor, mapped by the adaptor name
+	Adaptors map[string]*Limiter
+}
+
+// NewBandwidth will create the limiters from bandwidth-limit of settings and adaptors
+func NewBandwidth(conf Config) *Bandwidth {
+	bandwidth := &Bandwidth{Global: NewLimiter(conf.Settings.BandwidthLimit), Adaptors: make(map[string]*Limiter)}
+	for _, adaptor := range conf.Adaptors {
+		bandwidth.Adaptors[adaptor.Name] = NewLimiter(adaptor.BandwidthLimit)
+	}
+	return bandwidth
+}
+
+// For returns the limiters applicable to the transfers of the adaptor
+func (b *Bandwidth) For(adaptor string) []*Limiter {
+	if b == nil {
+		return nil
+	}
+	return []*Limiter{b.Global, b.Adaptors[adaptor]}
+}
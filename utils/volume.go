@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Part is a file of the archive which is transferred and verified on its own
+type Part struct {
+	// Suffix is appended to the archive path to get the part path, it is empty for the whole archive
+	Suffix string
+	// Checksum is the hex encoded sha256 of the part
+	Checksum string
+}
+
+// VolumeSuffix returns the suffix of the volume with the index, volumes are numbered from 0
+func VolumeSuffix(index int) string {
+	return fmt.Sprintf(".part-%04d", index)
+}
+
+// SplitCommand returns the command listing and splitting the archive, it prints the checksums of the list and volumes
+func SplitCommand(archive string, archiver Archiver, size Size) string {
+	dir, name := path.Split(archive)
+	return InDir(dir, strings.Join([]string{
+		archiver.List(name) + " > " + Quote(name+".list"),
+		BuildCommand("split", "-b", fmt.Sprint(int64(size)), "-d", "-a", "4", name, name+".part-"),
+		BuildCommand("rm", "-f", "--", name),
+		// glob sorts the volumes by their number
+		BuildCommand("sha256sum", name+".list") + " " + Quote(name) + ".part-*",
+	}, " && "))
+}
+
+// SplitArchive will write the entries of the archive to "<archive>.list" and split the archive into volumes of the
+// size, the archive itself is removed to save the space. It returns the list and the volumes with their checksums
+func SplitArchive(exec Executor, archive string, archiver Archiver, size Size) (Part, []Part, error) {
+	name := path.Base(archive)
+	output, err := exec.Run(SplitCommand(archive, archiver, size))
+	if err != nil {
+		return Part{}, nil, err
+	}
+
+	var list Part
+	volumes := make([]Part, 0)
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return Part{}, nil, fmt.Errorf("malformed checksum line %q", line)
+		}
+
+		part := Part{Suffix: strings.TrimPrefix(fields[1], name), Checksum: fields[0]}
+		if part.Suffix == ".list" {
+			list = part
+		} else {
+			volumes = append(volumes, part)
+		}
+	}
+	return list, volumes, nil
+}
+
+// abortAttempts is the number of times the abort marker of the streaming extraction is tried to be written
+const abortAttempts = 5
+
+// StreamExtractCommand returns the command extracting the volumes of the archive in order while they are being
+// uploaded. A volume is piped into the extract command once "<volume>.ok" marker exists, and removed right after.
+// The "<archive>.done" marker aborts the extraction while it is waiting for a volume
+func StreamExtractCommand(archive string, count int, extract string) string {
+	return fmt.Sprintf(`i=0; while [ $i -lt %d ]; do `+
+		`v=$(printf '%%s.part-%%04d' %s $i); `+
+		`while [ ! -e "$v.ok" ]; do [ -e %s ] && exit 1; sleep 1; done; `+
+		`cat "$v" && rm -f "$v" "$v.ok" || exit 1; `+
+		`i=$((i+1)); done | %s`, count, QuotePath(archive), QuotePath(archive+".done"), extract)
+}
+
+// ClearMarkersCommand returns the command removing the markers of the streaming extraction of the archive
+func ClearMarkersCommand(archive string) string {
+	// glob is kept out of the quotes
+	return fmt.Sprintf("rm -f -- %s %s.part-*.ok", QuotePath(archive+".done"), QuotePath(archive))
+}
+
+// ExtractVolumes will extract the volumes into dir on the destination while uploading them one by one from the
+// local archive path. Every volume is verified before it is handed to the extraction, and at most two volumes are
+// kept on the destination, so it doesn't need the space of the whole archive
+func ExtractVolumes(exec Executor, dir string, extract string, local string, remote string, volumes []Part, retries int, streams Streams) error {
+	cmd := ExtractCommand(dir, StreamExtractCommand(remote, len(volumes), extract))
+
+	// markers left by a killed run would hand the old volumes to the extraction or abort it right away
+	if _, err := exec.Run(ClearMarkersCommand(remote)); err != nil {
+		return err
+	}
+
+	var extractErr error
+	finished := make(chan struct{})
+	go func() {
+		_, extractErr = exec.Run(cmd)
+		close(finished)
+	}()
+
+	// abort will stop the extraction waiting for the next volume. The marker is retried, as the adaptor may be
+	// refusing new sessions for a while, and without it the extraction is left behind to end with the connection
+	abort := func(err error) error {
+		for attempt := 1; attempt <= abortAttempts; attempt++ {
+			_, touchErr := exec.Run(BuildCommand("touch", remote+".done"))
+			if touchErr == nil {
+				<-finished
+				return err
+			}
+			Log.Tracef("Couldn't abort the extraction of %s, attempt %d of %d. Error message: %s", remote, attempt, abortAttempts, touchErr.Error())
+
+			select {
+			case <-finished:
+				return err
+			case <-time.After(time.Second):
+			}
+		}
+		Log.Warnf("Leaving the extraction of %s behind, as it couldn't be aborted", remote)
+		return err
+	}
+
+	for i, volume := range volumes {
+		// the volume before previous one has to be extracted before uploading the next one
+		if i >= 2 {
+			if err := waitConsumed(exec, remote+volumes[i-2].Suffix, finished); err != nil {
+				// when the extraction has stopped, its error explains why
+				select {
+				case <-finished:
+					if extractErr != nil {
+						return extractErr
+					}
+					return err
+				default:
+					return abort(err)
+				}
+			}
+		}
+
+		src, dst := local+volume.Suffix, remote+volume.Suffix
+		upload := func() error { return ResumableUpload(exec, src, dst, streams) }
+		checksum := func() (string, error) { return RemoteChecksum(exec, dst) }
+		if err := VerifiedTransfer("upload of "+src, volume.Checksum, retries, upload, checksum); err != nil {
+			return abort(err)
+		}
+
+		if _, err := exec.Run(BuildCommand("touch", dst+".ok")); err != nil {
+			return abort(err)
+		}
+		Log.Tracef("Uploaded volume %d of %d to %s", i+1, len(volumes), dst)
+	}
+
+	<-finished
+	return extractErr
+}
+
+// waitConsumed will wait until the volume is removed by the extraction
+func waitConsumed(exec Executor, volume string, finished chan struct{}) error {
+	for {
+		output, err := exec.Run(fmt.Sprintf("[ -e %s ] && echo yes || echo no", QuotePath(volume)))
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(output) == "no" {
+			return nil
+		}
+
+		select {
+		case <-finished:
+			return fmt.Errorf("extraction stopped before reading %s", volume)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// VolumeFiles returns all the files of the split archive, including the markers of the streaming extraction
+// Only the archive is returned when it isn't split
+func VolumeFiles(archive string, count int) []string {
+	if count == 0 {
+		return []string{archive}
+	}
+
+	files := []string{archive, archive + ".list", archive + ".done"}
+	for i := 0; i < count; i++ {
+		files = append(files, archive+VolumeSuffix(i), archive+VolumeSuffix(i)+".ok")
+	}
+	return files
+}
+
+// validateVolumes will check the volume size of the files
+func (c *Config) validateVolumes() {
+	for i, file := range c.Files {
+		if file.VolumeSize == 0 {
+			continue
+		}
+
+		// zip volumes can't be extracted as a stream
+		if file.Format != "tar" {
+			Log.Fatalf("Volume size in files[%d] needs tar format", i)
+		}
+
+		if file.VolumeSize < 1<<20 {
+			Log.Fatalf("Volume size %s in files[%d] is less than 1M", file.VolumeSize, i)
+		}
+	}
+}